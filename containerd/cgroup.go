@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+)
+
+const (
+	// cgroupDriverCgroupfs manages container cgroups directly in the cgroup
+	// filesystem, under the cgroup parent path.
+	cgroupDriverCgroupfs = "cgroupfs"
+
+	// cgroupDriverSystemd manages container cgroups as systemd scopes, under
+	// the cgroup parent slice.
+	cgroupDriverSystemd = "systemd"
+
+	// systemdScopePrefix is the prefix of the systemd scope units created for
+	// containers with the systemd cgroup driver.
+	systemdScopePrefix = "nomad"
+
+	// Parent cgroups of the tasks with cgroup v2, same as Nomad's own layout.
+	// Tasks reserving cores (resources.cores) are placed under reserve.slice,
+	// and other tasks under share.slice, so that Nomad can partition the
+	// node's cpuset between them.
+	cgroupV2ShareParent   = "nomad.slice/share.slice"
+	cgroupV2ReserveParent = "nomad.slice/reserve.slice"
+
+	// cgroupSystemdParent is the default parent slice with the systemd cgroup driver.
+	cgroupSystemdParent = "nomad.slice"
+)
+
+// validateCgroupConfig checks the cgroup settings of the plugin config.
+func validateCgroupConfig(config *Config) error {
+	switch config.CgroupDriver {
+	case cgroupDriverCgroupfs:
+	case cgroupDriverSystemd:
+		if config.CgroupParent != "" && !strings.HasSuffix(config.CgroupParent, ".slice") {
+			return fmt.Errorf("cgroup_parent must be a systemd slice e.g. nomad.slice, when cgroup_driver is systemd")
+		}
+	default:
+		return fmt.Errorf("Invalid cgroup_driver %q. Supported values are %s and %s", config.CgroupDriver, cgroupDriverCgroupfs, cgroupDriverSystemd)
+	}
+	return nil
+}
+
+// cgroupsPath returns the cgroup path of a container of the task, named name.
+// The cgroup parent set in the plugin config supports %alloc_id% and %task%
+// placeholders. By default, containers are placed in Nomad's cgroup layout.
+func (d *Driver) cgroupsPath(cfg *drivers.TaskConfig, name string) string {
+	parent := d.config.CgroupParent
+	if parent == "" {
+		parent = d.defaultCgroupParent(cfg)
+	}
+	parent = strings.NewReplacer("%alloc_id%", cfg.AllocID, "%task%", cfg.Name).Replace(parent)
+
+	// The systemd cgroup driver expects <parent slice>:<scope prefix>:<name>.
+	if d.config.CgroupDriver == cgroupDriverSystemd {
+		return fmt.Sprintf("%s:%s:%s", parent, systemdScopePrefix, name)
+	}
+
+	if cgroups.IsCgroup2UnifiedMode() {
+		name += ".scope"
+	}
+	return "/" + strings.Trim(parent, "/") + "/" + name
+}
+
+// defaultCgroupParent returns the cgroup parent used when none is set in the
+// plugin config.
+func (d *Driver) defaultCgroupParent(cfg *drivers.TaskConfig) string {
+	if d.config.CgroupDriver == cgroupDriverSystemd {
+		return cgroupSystemdParent
+	}
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return d.namespace
+	}
+	if cfg.Resources != nil && cfg.Resources.LinuxResources != nil && cfg.Resources.LinuxResources.CpusetCpus != "" {
+		return cgroupV2ReserveParent
+	}
+	return cgroupV2ShareParent
+}
+
+// validateCgroupUnified checks that the cgroup v2 settings set in the task
+// config are allowed by allowed_cgroup_unified in the plugin config.
+func (d *Driver) validateCgroupUnified(unified map[string]string) error {
+	if len(unified) == 0 {
+		return nil
+	}
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return fmt.Errorf("cgroup_unified is only supported with cgroup v2, but the node uses cgroup v1.")
+	}
+
+	for key := range unified {
+		allowed := false
+		for _, allowedKey := range d.config.AllowedUnified {
+			if key == allowedKey {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("cgroup_unified key %s is not allowed. Add it to allowed_cgroup_unified in plugin config to allow it.", key)
+		}
+	}
+	return nil
+}
+
+// cgroupName returns the name of the cgroup of the task's main container.
+func cgroupName(cfg *drivers.TaskConfig) string {
+	return fmt.Sprintf("%s.%s", cfg.AllocID, cfg.Name)
+}
+
+// withRuntime returns the container option setting the containerd runtime,
+// configured for the cgroup driver in use.
+func (d *Driver) withRuntime() containerd.NewContainerOpts {
+	var runtimeOptions interface{}
+	if d.config.CgroupDriver == cgroupDriverSystemd {
+		runtimeOptions = &options.Options{SystemdCgroup: true}
+	}
+	return containerd.WithRuntime(d.config.ContainerdRuntime, runtimeOptions)
+}
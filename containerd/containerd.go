@@ -20,6 +20,7 @@ package containerd
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -27,6 +28,7 @@ import (
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/oci"
 	refdocker "github.com/containerd/containerd/reference/docker"
 	remotesdocker "github.com/containerd/containerd/remotes/docker"
@@ -34,10 +36,30 @@ import (
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+const (
+	// allocIDLabel is the container label holding the task's allocation ID.
+	allocIDLabel = "com.hashicorp.nomad.alloc_id"
+
+	// taskNameLabel is the container label holding the task's name.
+	taskNameLabel = "com.hashicorp.nomad.task_name"
+
+	// allocDirLabel is the container label holding the task's alloc dir.
+	allocDirLabel = "com.hashicorp.nomad.alloc_dir"
+
+	// preserveRootfsLabel is set on containers which are kept, along with
+	// their snapshot, when the task is destroyed.
+	preserveRootfsLabel = "com.hashicorp.nomad.preserve_rootfs"
+
+	// initPath is the path in the container at which the init binary,
+	// configured with init_path in the plugin config, is mounted.
+	initPath = "/sbin/nomad-init"
+)
+
 type ContainerConfig struct {
 	Image                 containerd.Image
 	ContainerName         string
 	ContainerSnapshotName string
+	CgroupsPath           string
 	NetworkNamespacePath  string
 	SecretsDirSrc         string
 	TaskDirSrc            string
@@ -48,8 +70,18 @@ type ContainerConfig struct {
 	Env                   []string
 	MemoryLimit           int64
 	MemoryHardLimit       int64
+	MemorySwap            int64
+	Swappiness            int64
 	CPUShares             int64
+	CPUQuota              int64
+	CPUPeriod             uint64
+	CpusetCpus            string
+	CpusetMems            string
+	BlockIO               *specs.LinuxBlockIO
+	Rlimits               []specs.POSIXRlimit
+	HugepageLimits        []specs.LinuxHugepageLimit
 	User                  string
+	Labels                map[string]string
 }
 
 func (d *Driver) isContainerdRunning() (bool, error) {
@@ -116,6 +148,57 @@ func (d *Driver) pullImage(imageName, imagePullTimeout string, auth *RegistryAut
 }
 
 func (d *Driver) createContainer(containerConfig *ContainerConfig, config *TaskConfig) (containerd.Container, error) {
+	opts, err := d.buildSpecOpts(containerConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	return d.client.NewContainer(
+		ctxWithTimeout,
+		containerConfig.ContainerName,
+		d.withRuntime(),
+		containerd.WithContainerLabels(containerConfig.Labels),
+		containerd.WithNewSnapshot(containerConfig.ContainerSnapshotName, containerConfig.Image),
+		containerd.WithNewSpec(opts...),
+	)
+}
+
+// reuseContainer loads the container left behind by a previous run of the task,
+// and regenerates its spec from the task config, keeping its snapshot (and any
+// data the task wrote into its rootfs). It returns nil if there is no such container.
+func (d *Driver) reuseContainer(containerConfig *ContainerConfig, config *TaskConfig) (containerd.Container, error) {
+	container, err := d.loadContainer(containerConfig.ContainerName)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := d.buildSpecOpts(containerConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	// Remove the task of the previous run, if it wasn't destroyed.
+	if err := d.deleteTask(container); err != nil {
+		return nil, err
+	}
+
+	if err := container.Update(ctxWithTimeout, containerd.UpdateContainerOpts(containerd.WithNewSpec(opts...))); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// buildSpecOpts returns the options used to generate the container spec.
+func (d *Driver) buildSpecOpts(containerConfig *ContainerConfig, config *TaskConfig) ([]oci.SpecOpts, error) {
 	if config.Command != "" && config.Entrypoint != nil {
 		return nil, fmt.Errorf("Both command and entrypoint are set. Only one of them needs to be set.")
 	}
@@ -145,6 +228,18 @@ func (d *Driver) createContainer(containerConfig *ContainerConfig, config *TaskC
 		opts = append(opts, oci.WithImageConfigArgs(containerConfig.Image, args))
 	}
 
+	// Run an init process as PID 1, which reaps zombies and forwards signals
+	// to the container process.
+	if config.Init {
+		if d.config.InitPath == "" {
+			return nil, fmt.Errorf("init_path must be set in plugin config, in order to use init.")
+		}
+		if _, err := os.Stat(d.config.InitPath); err != nil {
+			return nil, fmt.Errorf("Error in finding init binary: %v", err)
+		}
+		opts = append(opts, WithInit(initPath))
+	}
+
 	if !d.config.AllowPrivileged && config.Privileged {
 		return nil, fmt.Errorf("Running privileged jobs are not allowed. Set allow_privileged to true in plugin config to allow running privileged jobs.")
 	}
@@ -222,15 +317,76 @@ func (d *Driver) createContainer(containerConfig *ContainerConfig, config *TaskC
 		opts = append(opts, oci.WithProcessCwd(config.Cwd))
 	}
 
+	// Add OCI hooks.
+	hooks, err := d.buildHooks(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) > 0 {
+		opts = append(opts, WithHooks(hooks))
+	}
+
+	// Set the cgroup of the container.
+	if containerConfig.CgroupsPath != "" {
+		opts = append(opts, oci.WithCgroup(containerConfig.CgroupsPath))
+	}
+
 	// Set environment variables.
 	opts = append(opts, oci.WithEnv(containerConfig.Env))
 
 	// Set cgroups memory limit.
 	opts = append(opts, WithMemoryLimits(containerConfig.MemoryLimit, containerConfig.MemoryHardLimit))
 
+	// Set cgroups memory+swap limit and swappiness.
+	opts = append(opts, WithMemorySwap(containerConfig.MemorySwap, containerConfig.Swappiness))
+
 	// Set CPU Shares.
 	opts = append(opts, oci.WithCPUShares(uint64(containerConfig.CPUShares)))
 
+	// Set CFS quota and period, to enforce a hard CPU limit (cpu.max with cgroup v2).
+	if containerConfig.CPUQuota > 0 {
+		opts = append(opts, oci.WithCPUCFS(containerConfig.CPUQuota, containerConfig.CPUPeriod))
+	}
+
+	// Pin the container to CPUs and memory nodes.
+	if containerConfig.CpusetCpus != "" {
+		opts = append(opts, oci.WithCPUs(containerConfig.CpusetCpus))
+	}
+	if containerConfig.CpusetMems != "" {
+		opts = append(opts, oci.WithCPUsMems(containerConfig.CpusetMems))
+	}
+
+	// Set block IO weight and throttling.
+	if containerConfig.BlockIO != nil {
+		opts = append(opts, WithBlockIO(containerConfig.BlockIO))
+	}
+
+	// Set process resource limits.
+	if len(containerConfig.Rlimits) > 0 {
+		opts = append(opts, WithRlimits(containerConfig.Rlimits))
+	}
+
+	// Set hugetlb limits.
+	if len(containerConfig.HugepageLimits) > 0 {
+		opts = append(opts, WithHugepageLimits(containerConfig.HugepageLimits))
+	}
+
+	// Adjust the likelihood of the container process to be killed on OOM.
+	if config.OOMScoreAdj != 0 {
+		opts = append(opts, WithOOMScoreAdj(config.OOMScoreAdj))
+	}
+
+	// Kill all processes of the container together on OOM (memory.oom.group).
+	if config.OOMGroup {
+		opts = append(opts, WithOOMGroup())
+	}
+
+	// Set raw cgroup v2 settings. These take precedence over the settings
+	// derived from other options.
+	if len(config.CgroupUnified) > 0 {
+		opts = append(opts, WithCgroupUnified(config.CgroupUnified))
+	}
+
 	// Set Hostname
 	hostname := containerConfig.ContainerName
 	if config.Hostname != "" {
@@ -239,59 +395,58 @@ func (d *Driver) createContainer(containerConfig *ContainerConfig, config *TaskC
 	opts = append(opts, oci.WithHostname(hostname))
 
 	// Add linux devices into the container.
+	// Devices are given as <host path>[:<container path>][:<permissions>], and
+	// directories are expanded to the devices they contain.
 	for _, device := range config.Devices {
-		opts = append(opts, oci.WithLinuxDevice(device, "rwm"))
+		hostPath, containerPath, permissions, err := parseDevice(device)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, oci.WithDevices(hostPath, containerPath, permissions))
 	}
 
-	// Set mounts. fstab style mount options are supported.
-	// List of all supported mount options.
-	// https://github.com/containerd/containerd/blob/master/mount/mount_linux.go#L187-L211
-	mounts := make([]specs.Mount, 0)
-	for _, mount := range config.Mounts {
-		if (mount.Type == "bind" || mount.Type == "volume") && len(mount.Options) <= 0 {
-			return nil, fmt.Errorf("Options cannot be empty for mount type: %s. You need to atleast pass rbind and ro.", mount.Type)
+	// Allow access to devices matching the device cgroup rules.
+	if len(config.DeviceRules) > 0 {
+		if !d.config.AllowDeviceRules {
+			return nil, fmt.Errorf("Device cgroup rules are not allowed. Set allow_device_cgroup_rules to true in plugin config to allow setting device_cgroup_rules.")
 		}
-
-		// Allow paths relative to $NOMAD_TASK_DIR.
-		// More details: https://github.com/Roblox/nomad-driver-containerd/issues/116#issuecomment-983171458
-		if mount.Type == "bind" && strings.HasPrefix(mount.Source, "local") {
-			mount.Source = containerConfig.TaskDirSrc + mount.Source[5:]
+		rules, err := parseDeviceCgroupRules(config.DeviceRules)
+		if err != nil {
+			return nil, err
 		}
-
-		m := buildMountpoint(mount.Type, mount.Target, mount.Source, mount.Options)
-		mounts = append(mounts, m)
+		opts = append(opts, WithDeviceCgroupRules(rules))
 	}
 
-	// Setup host DNS (/etc/resolv.conf) into the container.
-	if config.HostDNS {
-		dnsMount := buildMountpoint("bind", "/etc/resolv.conf", "/etc/resolv.conf", []string{"rbind", "ro"})
-		mounts = append(mounts, dnsMount)
+	mounts, err := buildMounts(config.Mounts, containerConfig.TaskDirSrc)
+	if err != nil {
+		return nil, err
 	}
 
-	// Setup "/secrets" (NOMAD_SECRETS_DIR) in the container.
-	if containerConfig.SecretsDirSrc != "" && containerConfig.SecretsDirDest != "" {
-		secretsMount := buildMountpoint("bind", containerConfig.SecretsDirDest, containerConfig.SecretsDirSrc, []string{"rbind", "rw"})
-		mounts = append(mounts, secretsMount)
+	// Setup hugetlbfs, to allocate hugepages from, in the container.
+	if config.HugepagesMount != "" {
+		mounts = append(mounts, hugetlbfsMount(config.HugepagesMount, containerConfig.HugepageLimits))
 	}
 
-	// Setup "/local" (NOMAD_TASK_DIR) in the container.
-	if containerConfig.TaskDirSrc != "" && containerConfig.TaskDirDest != "" {
-		taskMount := buildMountpoint("bind", containerConfig.TaskDirDest, containerConfig.TaskDirSrc, []string{"rbind", "rw"})
-		mounts = append(mounts, taskMount)
+	// Setup init binary into the container.
+	if config.Init {
+		initMount := buildMountpoint("bind", initPath, d.config.InitPath, []string{"rbind", "ro"})
+		mounts = append(mounts, initMount)
 	}
 
-	// Setup "/alloc" (NOMAD_ALLOC_DIR) in the container.
-	if containerConfig.AllocDirSrc != "" && containerConfig.AllocDirDest != "" {
-		allocMount := buildMountpoint("bind", containerConfig.AllocDirDest, containerConfig.AllocDirSrc, []string{"rbind", "rw"})
-		mounts = append(mounts, allocMount)
+	// Setup host DNS (/etc/resolv.conf) into the container.
+	if config.HostDNS {
+		dnsMount := buildMountpoint("bind", "/etc/resolv.conf", "/etc/resolv.conf", []string{"rbind", "ro"})
+		mounts = append(mounts, dnsMount)
 	}
 
+	mounts = append(mounts, taskDirMounts(containerConfig)...)
+
 	// User will specify extra_hosts to be added to container's /etc/hosts.
 	// If host_network=true, extra_hosts will be added to host's /etc/hosts.
 	// If host_network=false, extra hosts will be added to the default /etc/hosts provided to the container.
 	// If the user doesn't set anything (host_network, extra_hosts), a default /etc/hosts will be provided to the container.
 	var extraHostsMount specs.Mount
-	hostsFile := containerConfig.TaskDirSrc + "/etc_hosts"
+	hostsFile := hostsFilePath(containerConfig.TaskDirSrc)
 	if len(config.ExtraHosts) > 0 {
 		if config.HostNetwork {
 			if err := etchosts.CopyEtcHosts(hostsFile); err != nil {
@@ -333,16 +488,90 @@ func (d *Driver) createContainer(containerConfig *ContainerConfig, config *TaskC
 		opts = append(opts, oci.WithUser(containerConfig.User))
 	}
 
+	return opts, nil
+}
+
+// buildHooks returns the OCI hooks of the task's containers. Plugin hooks run
+// before task hooks of the same stage.
+func (d *Driver) buildHooks(config *TaskConfig) ([]Hook, error) {
+	// Task hooks are restricted to the hook binaries allowed in the plugin config,
+	// since they are executed on the host with the runtime's privileges.
+	for _, hook := range config.Hooks {
+		if !isHookAllowed(hook.Path, d.config.AllowedHooks) {
+			return nil, fmt.Errorf("Hook %s is not allowed. Add it to allowed_hooks in plugin config to allow it.", hook.Path)
+		}
+		// Args and env could make an allowed hook run code chosen by the job.
+		if len(hook.Args) > 0 || len(hook.Env) > 0 {
+			return nil, fmt.Errorf("Hook %s can't set args or env in task config. Only hooks in plugin config can.", hook.Path)
+		}
+	}
+
+	return append(append([]Hook{}, d.config.Hooks...), config.Hooks...), nil
+}
+
+// buildMounts converts the mounts set in the task config to OCI mounts.
+// fstab style mount options are supported.
+// List of all supported mount options.
+// https://github.com/containerd/containerd/blob/master/mount/mount_linux.go#L187-L211
+func buildMounts(configMounts []Mount, taskDirSrc string) ([]specs.Mount, error) {
+	mounts := make([]specs.Mount, 0)
+	for _, mount := range configMounts {
+		if (mount.Type == "bind" || mount.Type == "volume") && len(mount.Options) <= 0 {
+			return nil, fmt.Errorf("Options cannot be empty for mount type: %s. You need to atleast pass rbind and ro.", mount.Type)
+		}
+
+		// Allow paths relative to $NOMAD_TASK_DIR.
+		// More details: https://github.com/Roblox/nomad-driver-containerd/issues/116#issuecomment-983171458
+		if mount.Type == "bind" && strings.HasPrefix(mount.Source, "local") {
+			mount.Source = taskDirSrc + mount.Source[5:]
+		}
+
+		m := buildMountpoint(mount.Type, mount.Target, mount.Source, mount.Options)
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// taskDirMounts returns the mounts of the secrets, task and alloc directories.
+func taskDirMounts(containerConfig *ContainerConfig) []specs.Mount {
+	var mounts []specs.Mount
+
+	// Setup "/secrets" (NOMAD_SECRETS_DIR) in the container.
+	if containerConfig.SecretsDirSrc != "" && containerConfig.SecretsDirDest != "" {
+		secretsMount := buildMountpoint("bind", containerConfig.SecretsDirDest, containerConfig.SecretsDirSrc, []string{"rbind", "rw"})
+		mounts = append(mounts, secretsMount)
+	}
+
+	// Setup "/local" (NOMAD_TASK_DIR) in the container.
+	if containerConfig.TaskDirSrc != "" && containerConfig.TaskDirDest != "" {
+		taskMount := buildMountpoint("bind", containerConfig.TaskDirDest, containerConfig.TaskDirSrc, []string{"rbind", "rw"})
+		mounts = append(mounts, taskMount)
+	}
+
+	// Setup "/alloc" (NOMAD_ALLOC_DIR) in the container.
+	if containerConfig.AllocDirSrc != "" && containerConfig.AllocDirDest != "" {
+		allocMount := buildMountpoint("bind", containerConfig.AllocDirDest, containerConfig.AllocDirSrc, []string{"rbind", "rw"})
+		mounts = append(mounts, allocMount)
+	}
+	return mounts
+}
+
+// deleteTask kills and deletes the task of the container, if any.
+func (d *Driver) deleteTask(container containerd.Container) error {
 	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
 	defer cancel()
 
-	return d.client.NewContainer(
-		ctxWithTimeout,
-		containerConfig.ContainerName,
-		containerd.WithRuntime(d.config.ContainerdRuntime, nil),
-		containerd.WithNewSnapshot(containerConfig.ContainerSnapshotName, containerConfig.Image),
-		containerd.WithNewSpec(opts...),
-	)
+	task, err := container.Task(ctxWithTimeout, nil)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := task.Delete(ctxWithTimeout, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	return nil
 }
 
 func (d *Driver) loadContainer(id string) (containerd.Container, error) {
@@ -352,7 +581,7 @@ func (d *Driver) loadContainer(id string) (containerd.Container, error) {
 	return d.client.LoadContainer(ctxWithTimeout, id)
 }
 
-func (d *Driver) createTask(container containerd.Container, stdoutPath, stderrPath string) (containerd.Task, error) {
+func (d *Driver) createTask(container containerd.Container, stdoutPath, stderrPath string, opts ...containerd.NewTaskOpts) (containerd.Task, error) {
 	stdout, stderr, err := getStdoutStderrFifos(stdoutPath, stderrPath)
 	if err != nil {
 		return nil, err
@@ -361,7 +590,7 @@ func (d *Driver) createTask(container containerd.Container, stdoutPath, stderrPa
 	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
 	defer cancel()
 
-	return container.NewTask(ctxWithTimeout, cio.NewCreator(cio.WithStreams(nil, stdout, stderr)))
+	return container.NewTask(ctxWithTimeout, cio.NewCreator(cio.WithStreams(nil, stdout, stderr)), opts...)
 }
 
 func (d *Driver) getTask(container containerd.Container, stdoutPath, stderrPath string) (containerd.Task, error) {
@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildHooks(t *testing.T) {
+	pluginHook := Hook{Stage: "prestart", Path: "/usr/local/bin/plugin-hook", Args: []string{"--verbose"}, Env: []string{"DEBUG=1"}}
+	taskHook := Hook{Stage: "poststop", Path: "/usr/local/bin/task-hook", Timeout: 10}
+
+	cases := []struct {
+		name     string
+		allowed  []string
+		hooks    []Hook
+		expected []Hook
+		err      bool
+	}{
+		{
+			name:     "plugin hooks only",
+			expected: []Hook{pluginHook},
+		},
+		{
+			name:     "allowed task hook runs after plugin hooks",
+			allowed:  []string{"/usr/local/bin/task-hook"},
+			hooks:    []Hook{taskHook},
+			expected: []Hook{pluginHook, taskHook},
+		},
+		{
+			name:     "allowed path is cleaned",
+			allowed:  []string{"/usr/local/bin/../bin/task-hook"},
+			hooks:    []Hook{taskHook},
+			expected: []Hook{pluginHook, taskHook},
+		},
+		{
+			name:  "no allowed hooks",
+			hooks: []Hook{taskHook},
+			err:   true,
+		},
+		{
+			name:    "path outside the allowlist",
+			allowed: []string{"/usr/local/bin/task-hook"},
+			hooks:   []Hook{{Stage: "prestart", Path: "/tmp/task-hook"}},
+			err:     true,
+		},
+		{
+			name:    "task hook with args",
+			allowed: []string{"/usr/local/bin/task-hook"},
+			hooks:   []Hook{{Stage: "prestart", Path: "/usr/local/bin/task-hook", Args: []string{"--config=/tmp/x"}}},
+			err:     true,
+		},
+		{
+			name:    "task hook with env",
+			allowed: []string{"/usr/local/bin/task-hook"},
+			hooks:   []Hook{{Stage: "prestart", Path: "/usr/local/bin/task-hook", Env: []string{"LD_PRELOAD=/tmp/x.so"}}},
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Driver{config: &Config{Hooks: []Hook{pluginHook}, AllowedHooks: tc.allowed}}
+
+			hooks, err := d.buildHooks(&TaskConfig{Hooks: tc.hooks})
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", hooks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(hooks, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, hooks)
+			}
+		})
+	}
+}
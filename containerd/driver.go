@@ -20,6 +20,11 @@ package containerd
 import (
 	"context"
 	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -38,6 +43,7 @@ import (
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	"github.com/hashicorp/nomad/plugins/shared/structs"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 const (
@@ -58,7 +64,29 @@ const (
 	// and understands how to decode
 	// this is used to allow modification and migration of the task schema
 	// used by the plugin
-	taskHandleVersion = 1
+	// Version 2 adds the containerd namespace and socket to TaskState.
+	taskHandleVersion = 2
+
+	// containerdSocket is the path of the containerd socket the driver talks to.
+	containerdSocket = "/run/containerd/containerd.sock"
+
+	// pauseSignal is the pseudo-signal accepted by SignalTask to freeze
+	// the task's cgroup.
+	pauseSignal = "PAUSE"
+
+	// resumeSignal is the pseudo-signal accepted by SignalTask to thaw
+	// a paused task.
+	resumeSignal = "RESUME"
+
+	// defaultCPUCFSPeriod is the CFS period, in microseconds, used to enforce
+	// a hard CPU limit when no period is set.
+	defaultCPUCFSPeriod = 100000
+
+	// onlineCPUsPath lists the online CPUs of the node.
+	onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+	// onlineNodesPath lists the online NUMA (memory) nodes of the node.
+	onlineNodesPath = "/sys/devices/system/node/online"
 )
 
 var (
@@ -85,10 +113,62 @@ var (
 			hclspec.NewAttr("allow_privileged", "bool", false),
 			hclspec.NewLiteral("true"),
 		),
+		"init_path": hclspec.NewAttr("init_path", "string", false),
 		"auth": hclspec.NewBlock("auth", false, hclspec.NewObject(map[string]*hclspec.Spec{
 			"username": hclspec.NewAttr("username", "string", true),
 			"password": hclspec.NewAttr("password", "string", true),
 		})),
+		"dangling_containers": hclspec.NewDefault(
+			hclspec.NewBlock("dangling_containers", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"enabled": hclspec.NewDefault(
+					hclspec.NewAttr("enabled", "bool", false),
+					hclspec.NewLiteral("true"),
+				),
+				"period": hclspec.NewDefault(
+					hclspec.NewAttr("period", "string", false),
+					hclspec.NewLiteral(`"5m"`),
+				),
+				"creation_grace": hclspec.NewDefault(
+					hclspec.NewAttr("creation_grace", "string", false),
+					hclspec.NewLiteral(`"5m"`),
+				),
+			})),
+			hclspec.NewLiteral(`{
+				enabled = true
+				period = "5m"
+				creation_grace = "5m"
+			}`),
+		),
+		"hooks": hclspec.NewBlockList("hooks", hclspec.NewObject(map[string]*hclspec.Spec{
+			"stage":   hclspec.NewAttr("stage", "string", true),
+			"path":    hclspec.NewAttr("path", "string", true),
+			"args":    hclspec.NewAttr("args", "list(string)", false),
+			"env":     hclspec.NewAttr("env", "list(string)", false),
+			"timeout": hclspec.NewAttr("timeout", "number", false),
+		})),
+		"allowed_hooks": hclspec.NewAttr("allowed_hooks", "list(string)", false),
+		"memory_swap":   hclspec.NewAttr("memory_swap", "string", false),
+		"allow_swap": hclspec.NewDefault(
+			hclspec.NewAttr("allow_swap", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"ulimit":     hclspec.NewAttr("ulimit", "list(map(string))", false),
+		"max_ulimit": hclspec.NewAttr("max_ulimit", "list(map(string))", false),
+		"oom_score_adj_min": hclspec.NewDefault(
+			hclspec.NewAttr("oom_score_adj_min", "number", false),
+			hclspec.NewLiteral("0"),
+		),
+		"oom_score_adj_max": hclspec.NewDefault(
+			hclspec.NewAttr("oom_score_adj_max", "number", false),
+			hclspec.NewLiteral("1000"),
+		),
+		"cgroup_parent": hclspec.NewAttr("cgroup_parent", "string", false),
+		"cgroup_driver": hclspec.NewDefault(
+			hclspec.NewAttr("cgroup_driver", "string", false),
+			hclspec.NewLiteral(`"cgroupfs"`),
+		),
+		"allowed_cgroup_unified":    hclspec.NewAttr("allowed_cgroup_unified", "list(string)", false),
+		"allow_device_cgroup_rules": hclspec.NewAttr("allow_device_cgroup_rules", "bool", false),
 	})
 
 	// taskConfigSpec is the specification of the plugin's configuration for
@@ -136,6 +216,85 @@ var (
 			"source":  hclspec.NewAttr("source", "string", false),
 			"options": hclspec.NewAttr("options", "list(string)", false),
 		})),
+		"exec": hclspec.NewBlock("exec", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"user": hclspec.NewAttr("user", "string", false),
+			"env":  hclspec.NewAttr("env", "map(string)", false),
+			"cwd":  hclspec.NewAttr("cwd", "string", false),
+		})),
+		"checkpoint_on_stop": hclspec.NewAttr("checkpoint_on_stop", "bool", false),
+		"init":               hclspec.NewAttr("init", "bool", false),
+		"signal_all":         hclspec.NewAttr("signal_all", "bool", false),
+		"startup_grace":      hclspec.NewAttr("startup_grace", "string", false),
+		"ready_command":      hclspec.NewAttr("ready_command", "list(string)", false),
+		"healthcheck": hclspec.NewBlock("healthcheck", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"command":                hclspec.NewAttr("command", "list(string)", false),
+			"interval":               hclspec.NewAttr("interval", "string", false),
+			"timeout":                hclspec.NewAttr("timeout", "string", false),
+			"start_period":           hclspec.NewAttr("start_period", "string", false),
+			"retries":                hclspec.NewAttr("retries", "number", false),
+			"restart_after_failures": hclspec.NewAttr("restart_after_failures", "number", false),
+			"disable":                hclspec.NewAttr("disable", "bool", false),
+		})),
+		"post_start": hclspec.NewBlock("post_start", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"command": hclspec.NewAttr("command", "list(string)", true),
+			"timeout": hclspec.NewDefault(
+				hclspec.NewAttr("timeout", "string", false),
+				hclspec.NewLiteral(`"30s"`),
+			),
+		})),
+		"pre_stop": hclspec.NewBlock("pre_stop", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"command": hclspec.NewAttr("command", "list(string)", true),
+			"timeout": hclspec.NewDefault(
+				hclspec.NewAttr("timeout", "string", false),
+				hclspec.NewLiteral(`"30s"`),
+			),
+		})),
+		// Task hooks can't set args and env, which would let jobs control
+		// what an allowed hook binary runs on the host.
+		"hooks": hclspec.NewBlockList("hooks", hclspec.NewObject(map[string]*hclspec.Spec{
+			"stage":   hclspec.NewAttr("stage", "string", true),
+			"path":    hclspec.NewAttr("path", "string", true),
+			"timeout": hclspec.NewAttr("timeout", "number", false),
+		})),
+		"preserve_rootfs_on_restart": hclspec.NewAttr("preserve_rootfs_on_restart", "bool", false),
+		"cpu_hard_limit":             hclspec.NewAttr("cpu_hard_limit", "bool", false),
+		"cpu_cfs_period":             hclspec.NewAttr("cpu_cfs_period", "number", false),
+		"cpuset_cpus":                hclspec.NewAttr("cpuset_cpus", "string", false),
+		"cpuset_mems":                hclspec.NewAttr("cpuset_mems", "string", false),
+		"memory_swap":                hclspec.NewAttr("memory_swap", "string", false),
+		"memory_swappiness": hclspec.NewDefault(
+			hclspec.NewAttr("memory_swappiness", "number", false),
+			hclspec.NewLiteral("-1"),
+		),
+		"blkio": hclspec.NewBlock("blkio", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"weight":        hclspec.NewAttr("weight", "number", false),
+			"weight_device": hclspec.NewAttr("weight_device", "list(string)", false),
+			"read_bps":      hclspec.NewAttr("read_bps", "list(string)", false),
+			"write_bps":     hclspec.NewAttr("write_bps", "list(string)", false),
+			"read_iops":     hclspec.NewAttr("read_iops", "list(string)", false),
+			"write_iops":    hclspec.NewAttr("write_iops", "list(string)", false),
+		})),
+		"ulimit":          hclspec.NewAttr("ulimit", "list(map(string))", false),
+		"hugepages":       hclspec.NewAttr("hugepages", "list(map(string))", false),
+		"hugepages_mount": hclspec.NewAttr("hugepages_mount", "string", false),
+		"oom_score_adj":   hclspec.NewAttr("oom_score_adj", "number", false),
+		"oom_group":       hclspec.NewAttr("oom_group", "bool", false),
+		"cgroup_unified":  hclspec.NewAttr("cgroup_unified", "list(map(string))", false),
+		"init_containers": hclspec.NewBlockList("init_containers", hclspec.NewObject(map[string]*hclspec.Spec{
+			"image":   hclspec.NewAttr("image", "string", true),
+			"command": hclspec.NewAttr("command", "string", false),
+			"args":    hclspec.NewAttr("args", "list(string)", false),
+			"mounts": hclspec.NewBlockList("mounts", hclspec.NewObject(map[string]*hclspec.Spec{
+				"type": hclspec.NewDefault(
+					hclspec.NewAttr("type", "string", false),
+					hclspec.NewLiteral("\"volume\""),
+				),
+				"target":  hclspec.NewAttr("target", "string", true),
+				"source":  hclspec.NewAttr("source", "string", false),
+				"options": hclspec.NewAttr("options", "list(string)", false),
+			})),
+		})),
+		"device_cgroup_rules": hclspec.NewAttr("device_cgroup_rules", "list(string)", false),
 	})
 
 	// capabilities indicates what optional features this driver supports
@@ -151,11 +310,34 @@ var (
 
 // Config contains configuration information for the plugin
 type Config struct {
-	Enabled           bool         `codec:"enabled"`
-	ContainerdRuntime string       `codec:"containerd_runtime"`
-	StatsInterval     string       `codec:"stats_interval"`
-	AllowPrivileged   bool         `codec:"allow_privileged"`
-	Auth              RegistryAuth `codec:"auth"`
+	Enabled            bool                     `codec:"enabled"`
+	ContainerdRuntime  string                   `codec:"containerd_runtime"`
+	StatsInterval      string                   `codec:"stats_interval"`
+	AllowPrivileged    bool                     `codec:"allow_privileged"`
+	InitPath           string                   `codec:"init_path"`
+	Hooks              []Hook                   `codec:"hooks"`
+	AllowedHooks       []string                 `codec:"allowed_hooks"`
+	MemorySwap         string                   `codec:"memory_swap"`
+	AllowSwap          bool                     `codec:"allow_swap"`
+	Ulimit             hclutils.MapStrStr       `codec:"ulimit"`
+	MaxUlimit          hclutils.MapStrStr       `codec:"max_ulimit"`
+	OOMScoreAdjMin     int                      `codec:"oom_score_adj_min"`
+	OOMScoreAdjMax     int                      `codec:"oom_score_adj_max"`
+	CgroupParent       string                   `codec:"cgroup_parent"`
+	CgroupDriver       string                   `codec:"cgroup_driver"`
+	AllowedUnified     []string                 `codec:"allowed_cgroup_unified"`
+	AllowDeviceRules   bool                     `codec:"allow_device_cgroup_rules"`
+	Auth               RegistryAuth             `codec:"auth"`
+	DanglingContainers DanglingContainersConfig `codec:"dangling_containers"`
+}
+
+// DanglingContainersConfig configures the removal of containers created by
+// the driver which are no longer tracked by a task e.g. containers of
+// allocations garbage collected while the Nomad client was down.
+type DanglingContainersConfig struct {
+	Enabled       bool   `codec:"enabled"`
+	Period        string `codec:"period"`
+	CreationGrace string `codec:"creation_grace"`
 }
 
 // Volume, bind, and tmpfs type mounts are supported.
@@ -173,6 +355,54 @@ type RegistryAuth struct {
 	Password string `codec:"password"`
 }
 
+// ExecConfig contains the defaults applied to processes launched inside
+// the container via nomad alloc exec.
+type ExecConfig struct {
+	User string            `codec:"user"`
+	Env  map[string]string `codec:"env"`
+	Cwd  string            `codec:"cwd"`
+}
+
+// HealthcheckConfig configures the health probe executed inside the container.
+// It overrides the HEALTHCHECK declared in the image, if any.
+type HealthcheckConfig struct {
+	Command              []string `codec:"command"`
+	Interval             string   `codec:"interval"`
+	Timeout              string   `codec:"timeout"`
+	StartPeriod          string   `codec:"start_period"`
+	Retries              int      `codec:"retries"`
+	RestartAfterFailures int      `codec:"restart_after_failures"`
+	Disable              bool     `codec:"disable"`
+}
+
+// BlkioConfig configures the block IO weight and throttling of the container.
+// Per-device settings are given as <device path>:<value>, same as docker.
+type BlkioConfig struct {
+	Weight       uint16   `codec:"weight"`
+	WeightDevice []string `codec:"weight_device"`
+	ReadBps      []string `codec:"read_bps"`
+	WriteBps     []string `codec:"write_bps"`
+	ReadIops     []string `codec:"read_iops"`
+	WriteIops    []string `codec:"write_iops"`
+}
+
+// Hook is an OCI runtime hook, executed by the runtime at the given stage
+// of the container lifecycle.
+type Hook struct {
+	Stage   string   `codec:"stage"`
+	Path    string   `codec:"path"`
+	Args    []string `codec:"args"`
+	Env     []string `codec:"env"`
+	Timeout int      `codec:"timeout"`
+}
+
+// LifecycleHook is a command executed inside the container at a given point
+// of the task lifecycle.
+type LifecycleHook struct {
+	Command []string `codec:"command"`
+	Timeout string   `codec:"timeout"`
+}
+
 // TaskConfig contains configuration information for a task that runs with
 // this plugin
 type TaskConfig struct {
@@ -197,8 +427,34 @@ type TaskConfig struct {
 	Entrypoint       []string           `codec:"entrypoint"`
 	ReadOnlyRootfs   bool               `codec:"readonly_rootfs"`
 	HostNetwork      bool               `codec:"host_network"`
+	CheckpointOnStop bool               `codec:"checkpoint_on_stop"`
+	Init             bool               `codec:"init"`
+	PreserveRootfs   bool               `codec:"preserve_rootfs_on_restart"`
+	SignalAll        bool               `codec:"signal_all"`
+	CPUHardLimit     bool               `codec:"cpu_hard_limit"`
+	CPUCFSPeriod     int64              `codec:"cpu_cfs_period"`
+	CpusetCpus       string             `codec:"cpuset_cpus"`
+	CpusetMems       string             `codec:"cpuset_mems"`
+	MemorySwap       string             `codec:"memory_swap"`
+	Swappiness       int64              `codec:"memory_swappiness"`
+	Blkio            BlkioConfig        `codec:"blkio"`
+	Ulimit           hclutils.MapStrStr `codec:"ulimit"`
+	Hugepages        hclutils.MapStrStr `codec:"hugepages"`
+	HugepagesMount   string             `codec:"hugepages_mount"`
+	OOMScoreAdj      int                `codec:"oom_score_adj"`
+	OOMGroup         bool               `codec:"oom_group"`
+	CgroupUnified    hclutils.MapStrStr `codec:"cgroup_unified"`
+	DeviceRules      []string           `codec:"device_cgroup_rules"`
+	StartupGrace     string             `codec:"startup_grace"`
+	ReadyCommand     []string           `codec:"ready_command"`
+	Healthcheck      HealthcheckConfig  `codec:"healthcheck"`
+	PostStart        LifecycleHook      `codec:"post_start"`
+	PreStop          LifecycleHook      `codec:"pre_stop"`
+	Hooks            []Hook             `codec:"hooks"`
+	InitContainers   []InitContainer    `codec:"init_containers"`
 	Auth             RegistryAuth       `codec:"auth"`
 	Mounts           []Mount            `codec:"mounts"`
+	Exec             ExecConfig         `codec:"exec"`
 }
 
 // TaskState is the runtime state which is encoded in the handle returned to
@@ -210,6 +466,51 @@ type TaskState struct {
 	ContainerName string
 	StdoutPath    string
 	StderrPath    string
+	Namespace     string
+	Socket        string
+}
+
+// taskStateV1 is the runtime state encoded in handles of version 1.
+type taskStateV1 struct {
+	StartedAt     time.Time
+	ContainerName string
+	StdoutPath    string
+	StderrPath    string
+}
+
+// upgrade converts a version 1 task state to the current TaskState.
+// Version 1 handles didn't store the namespace and socket, which were the
+// defaults of the driver at the time.
+func (s *taskStateV1) upgrade() *TaskState {
+	return &TaskState{
+		StartedAt:     s.StartedAt,
+		ContainerName: s.ContainerName,
+		StdoutPath:    s.StdoutPath,
+		StderrPath:    s.StderrPath,
+		Namespace:     defaultNamespace(),
+		Socket:        containerdSocket,
+	}
+}
+
+// decodeTaskState decodes the task state from a handle, upgrading handles set
+// by older versions of the driver.
+func decodeTaskState(handle *drivers.TaskHandle) (*TaskState, error) {
+	switch handle.Version {
+	case 1:
+		var state taskStateV1
+		if err := handle.GetDriverState(&state); err != nil {
+			return nil, err
+		}
+		return state.upgrade(), nil
+	case taskHandleVersion:
+		var state TaskState
+		if err := handle.GetDriverState(&state); err != nil {
+			return nil, err
+		}
+		return &state, nil
+	default:
+		return nil, fmt.Errorf("unsupported task handle version: %d", handle.Version)
+	}
 }
 
 type Driver struct {
@@ -229,6 +530,10 @@ type Driver struct {
 	// tasks is the in memory datastore mapping taskIDs to driver handles
 	tasks *taskStore
 
+	// starting holds the tasks being started, whose containers (including
+	// init containers) must not be removed as dangling
+	starting *taskStore
+
 	// ctx is the context for the driver. It is passed to other subsystems to
 	// coordinate shutdown
 	ctx context.Context
@@ -243,8 +548,14 @@ type Driver struct {
 	// context for containerd
 	ctxContainerd context.Context
 
+	// containerd namespace used for all containerd API calls
+	namespace string
+
 	// containerd client
 	client *containerd.Client
+
+	// reaperOnce ensures the dangling containers reaper is only started once
+	reaperOnce sync.Once
 }
 
 // NewPlugin returns a new containerd driver plugin
@@ -254,35 +565,60 @@ func NewPlugin(logger log.Logger) drivers.DriverPlugin {
 
 	// This will create a new containerd client which will talk to
 	// default containerd socket path.
-	client, err := containerd.New("/run/containerd/containerd.sock")
+	client, err := containerd.New(containerdSocket)
 	if err != nil {
 		logger.Error("Error in creating containerd client", "err", err)
+		cancel()
 		return nil
 	}
 
-	// Calls to containerd API are namespaced.
-	// "nomad" is the namespace that will be used for all nomad-driver-containerd
-	// related containerd API calls.
-	namespace := "nomad"
-	// Unless we are operating in cgroups.v2 mode, in which case we use the
-	// name "nomad.slice", which ends up being the cgroup parent.
-	if cgroups.IsCgroup2UnifiedMode() {
-		namespace = "nomad.slice"
-	}
+	namespace := defaultNamespace()
 	ctxContainerd := namespaces.WithNamespace(context.Background(), namespace)
 
 	return &Driver{
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &Config{},
 		tasks:          newTaskStore(),
+		starting:       newTaskStore(),
 		ctx:            ctx,
 		ctxContainerd:  ctxContainerd,
+		namespace:      namespace,
 		client:         client,
 		signalShutdown: cancel,
 		logger:         logger,
 	}
 }
 
+// defaultNamespace returns the containerd namespace used by the driver.
+// Calls to containerd API are namespaced.
+// "nomad" is the namespace that will be used for all nomad-driver-containerd
+// related containerd API calls.
+// Unless we are operating in cgroups.v2 mode, in which case we use the
+// name "nomad.slice", which ends up being the cgroup parent.
+func defaultNamespace() string {
+	if cgroups.IsCgroup2UnifiedMode() {
+		return "nomad.slice"
+	}
+	return "nomad"
+}
+
+// setDevices adds the devices reserved for the task by Nomad device plugins
+// to the devices of the task.
+func (tc *TaskConfig) setDevices(cfg *drivers.TaskConfig) {
+	for _, device := range cfg.Devices {
+		permissions := device.Permissions
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		// Devices are mounted at the same path as on the host, unless set otherwise.
+		taskPath := device.TaskPath
+		if taskPath == "" {
+			taskPath = device.HostPath
+		}
+		tc.Devices = append(tc.Devices, fmt.Sprintf("%s:%s:%s", device.HostPath, taskPath, permissions))
+	}
+}
+
 func (tc *TaskConfig) setVolumeMounts(cfg *drivers.TaskConfig) error {
 	for _, m := range cfg.Mounts {
 		hm := Mount{
@@ -342,6 +678,48 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		d.compute = cfg.AgentConfig.Compute()
 	}
 
+	if config.MemorySwap != "" {
+		if _, err := parseMemorySwap(config.MemorySwap); err != nil {
+			return fmt.Errorf("failed to parse memory_swap: %v", err)
+		}
+	}
+
+	for name, value := range config.Ulimit {
+		if _, err := parseUlimit(name, value); err != nil {
+			return fmt.Errorf("failed to parse ulimit: %v", err)
+		}
+	}
+	for name, value := range config.MaxUlimit {
+		if _, err := parseUlimit(name, value); err != nil {
+			return fmt.Errorf("failed to parse max_ulimit: %v", err)
+		}
+	}
+
+	if config.OOMScoreAdjMin < -1000 || config.OOMScoreAdjMax > 1000 || config.OOMScoreAdjMin > config.OOMScoreAdjMax {
+		return fmt.Errorf("oom_score_adj_min and oom_score_adj_max must be between -1000 and 1000, and oom_score_adj_min must not be greater than oom_score_adj_max")
+	}
+
+	if config.CgroupDriver == "" {
+		config.CgroupDriver = cgroupDriverCgroupfs
+	}
+	if err := validateCgroupConfig(&config); err != nil {
+		return err
+	}
+
+	if config.DanglingContainers.Enabled {
+		period, err := time.ParseDuration(config.DanglingContainers.Period)
+		if err != nil {
+			return fmt.Errorf("failed to parse dangling_containers.period: %v", err)
+		}
+		grace, err := time.ParseDuration(config.DanglingContainers.CreationGrace)
+		if err != nil {
+			return fmt.Errorf("failed to parse dangling_containers.creation_grace: %v", err)
+		}
+		d.reaperOnce.Do(func() {
+			go d.reapDanglingContainers(period, grace)
+		})
+	}
+
 	return nil
 }
 
@@ -411,6 +789,17 @@ func (d *Driver) buildFingerprint() *drivers.Fingerprint {
 
 	fp.Attributes["driver.containerd.containerd_version"] = structs.NewStringAttribute(version.Version)
 	fp.Attributes["driver.containerd.containerd_revision"] = structs.NewStringAttribute(version.Revision)
+
+	// Hugepage sizes available on the node, and the number of pages of each size.
+	pools, err := hugepagePools(hugepagesDir)
+	if err != nil {
+		d.logger.Warn("Error in buildFingerprint(): failed to get hugepages:", "error", err)
+		return fp
+	}
+	for size, pool := range pools {
+		fp.Attributes["driver.containerd.hugepages."+size+".total"] = structs.NewIntAttribute(pool.total, "")
+		fp.Attributes["driver.containerd.hugepages."+size+".free"] = structs.NewIntAttribute(pool.free, "")
+	}
 	return fp
 }
 
@@ -420,6 +809,11 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		return nil, nil, fmt.Errorf("task with ID %q already started", cfg.ID)
 	}
 
+	// Track the task while it is started, which may take long e.g. while
+	// init containers run, so that its containers aren't reaped.
+	d.starting.Set(cfg.ID, &taskHandle{taskConfig: cfg})
+	defer d.starting.Delete(cfg.ID)
+
 	var driverConfig TaskConfig
 	if err := cfg.DecodeDriverConfig(&driverConfig); err != nil {
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
@@ -431,9 +825,36 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		return nil, nil, fmt.Errorf("host_network and bridge network mode are mutually exclusive, and only one of them should be set")
 	}
 
+	// Preserved containers are only removed by the dangling containers reaper,
+	// once their allocation is garbage collected.
+	if driverConfig.PreserveRootfs && !d.config.DanglingContainers.Enabled {
+		return nil, nil, fmt.Errorf("preserve_rootfs_on_restart requires dangling_containers to be enabled in plugin config, so that preserved containers are removed.")
+	}
+
 	if err := driverConfig.setVolumeMounts(cfg); err != nil {
 		return nil, nil, err
 	}
+	driverConfig.setDevices(cfg)
+
+	var startupGrace time.Duration
+	if driverConfig.StartupGrace != "" {
+		var err error
+		if startupGrace, err = time.ParseDuration(driverConfig.StartupGrace); err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse startup_grace: %v", err)
+		}
+	}
+	if len(driverConfig.ReadyCommand) > 0 && startupGrace <= 0 {
+		return nil, nil, fmt.Errorf("startup_grace must be set, in order to use ready_command.")
+	}
+
+	postStartTimeout, err := hookTimeout("post_start", &driverConfig.PostStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	preStopTimeout, err := hookTimeout("pre_stop", &driverConfig.PreStop)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	d.logger.Info("starting task", "driver_cfg", hclog.Fmt("%+v", driverConfig))
 	handle := drivers.NewTaskHandle(taskHandleVersion)
@@ -442,13 +863,9 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	// Use Nomad's docker naming convention for the container name
 	// https://www.nomadproject.io/docs/drivers/docker#container-name
 	containerName := cfg.Name + "-" + cfg.AllocID
-	if cgroups.IsCgroup2UnifiedMode() {
-		// In cgroup.v2 mode, the name is slightly different.
-		containerName = fmt.Sprintf("%s.%s.scope", cfg.AllocID, cfg.Name)
-	}
 	containerConfig.ContainerName = containerName
+	containerConfig.CgroupsPath = d.cgroupsPath(cfg, cgroupName(cfg))
 
-	var err error
 	containerConfig.Image, err = d.pullImage(driverConfig.Image, driverConfig.ImagePullTimeout, &driverConfig.Auth)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error in pulling image %s: %v", driverConfig.Image, err)
@@ -456,6 +873,11 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 
 	d.logger.Info(fmt.Sprintf("Successfully pulled %s image\n", containerConfig.Image.Name()))
 
+	hc, err := d.buildHealthcheck(containerConfig.Image, &driverConfig.Healthcheck)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Setup environment variables.
 	for key, val := range cfg.Env {
 		if skipOverride(key) {
@@ -474,7 +896,7 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	containerConfig.TaskDirDest = cfg.Env[taskenv.TaskLocalDir]
 	containerConfig.AllocDirDest = cfg.Env[taskenv.AllocDir]
 
-	containerConfig.ContainerSnapshotName = fmt.Sprintf("%s-snapshot", containerName)
+	containerConfig.ContainerSnapshotName = snapshotName(containerName)
 	if cfg.NetworkIsolation != nil && cfg.NetworkIsolation.Path != "" {
 		containerConfig.NetworkNamespacePath = cfg.NetworkIsolation.Path
 	}
@@ -484,16 +906,106 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	containerConfig.MemoryLimit = cfg.Resources.NomadResources.Memory.MemoryMB * 1024 * 1024
 	containerConfig.MemoryHardLimit = cfg.Resources.NomadResources.Memory.MemoryMaxMB * 1024 * 1024
 	containerConfig.CPUShares = cfg.Resources.LinuxResources.CPUShares
+	containerConfig.CPUQuota, containerConfig.CPUPeriod, err = cpuLimits(cfg.Resources.LinuxResources, &driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	containerConfig.MemorySwap, containerConfig.Swappiness, err = d.memorySwap(containerConfig.MemoryLimit, containerConfig.MemoryHardLimit, &driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	containerConfig.CpusetCpus, containerConfig.CpusetMems, err = cpusets(cfg.Resources.LinuxResources, &driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	containerConfig.BlockIO, err = buildBlockIO(&driverConfig.Blkio)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in setting blkio: %v", err)
+	}
+	containerConfig.Rlimits, err = d.ulimits(&driverConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in setting ulimit: %v", err)
+	}
+	containerConfig.HugepageLimits, err = buildHugepageLimits(driverConfig.Hugepages, hugepagesDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in setting hugepages: %v", err)
+	}
+
+	if driverConfig.OOMScoreAdj != 0 {
+		if driverConfig.OOMScoreAdj < d.config.OOMScoreAdjMin || driverConfig.OOMScoreAdj > d.config.OOMScoreAdjMax {
+			return nil, nil, fmt.Errorf("oom_score_adj must be between %d and %d. The range is set by oom_score_adj_min and oom_score_adj_max in plugin config.", d.config.OOMScoreAdjMin, d.config.OOMScoreAdjMax)
+		}
+	}
+	if driverConfig.OOMGroup && !cgroups.IsCgroup2UnifiedMode() {
+		return nil, nil, fmt.Errorf("oom_group is only supported with cgroup v2.")
+	}
+	if err := d.validateCgroupUnified(driverConfig.CgroupUnified); err != nil {
+		return nil, nil, err
+	}
 
 	containerConfig.User = cfg.User
 
-	container, err := d.createContainer(&containerConfig, &driverConfig)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Error in creating container: %v", err)
+	// Labels identify the task owning the container, so that dangling
+	// containers can be found and removed.
+	containerConfig.Labels = map[string]string{
+		allocIDLabel:  cfg.AllocID,
+		taskNameLabel: cfg.Name,
+		allocDirLabel: cfg.AllocDir,
+	}
+	if driverConfig.PreserveRootfs {
+		containerConfig.Labels[preserveRootfsLabel] = "true"
 	}
 
-	d.logger.Info(fmt.Sprintf("Successfully created container with name: %s\n", containerName))
-	task, err := d.createTask(container, cfg.StdoutPath, cfg.StderrPath)
+	// Run the init containers to completion, before the main container is created.
+	// The log FIFOs are shared by the init containers, and kept open until the
+	// main task is created: Nomad stops reading a FIFO once it has no writer.
+	if len(driverConfig.InitContainers) > 0 {
+		stdout, stderr, err := getStdoutStderrFifos(cfg.StdoutPath, cfg.StderrPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in opening log FIFOs: %v", err)
+		}
+		defer stdout.Close()
+		defer stderr.Close()
+
+		if err := d.runInitContainers(cfg, &containerConfig, &driverConfig, stdout, stderr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Reuse the container, and its rootfs, from the previous run of the task.
+	var container containerd.Container
+	if driverConfig.PreserveRootfs {
+		container, err = d.reuseContainer(&containerConfig, &driverConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in reusing container: %v", err)
+		}
+		if container != nil {
+			d.logger.Info(fmt.Sprintf("Reusing container with name: %s\n", containerName))
+		}
+	}
+
+	if container == nil {
+		container, err = d.createContainer(&containerConfig, &driverConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in creating container: %v", err)
+		}
+
+		d.logger.Info(fmt.Sprintf("Successfully created container with name: %s\n", containerName))
+	}
+
+	// Restore the task from the checkpoint taken when it was last stopped.
+	var taskOpts []containerd.NewTaskOpts
+	var restoreDir string
+	if driverConfig.CheckpointOnStop && hasCheckpoint(checkpointDir(cfg)) {
+		restoreDir = checkpointDir(cfg)
+		taskOpts = append(taskOpts, containerd.WithRestoreImagePath(restoreDir))
+	}
+
+	task, err := d.createTask(container, cfg.StdoutPath, cfg.StderrPath, taskOpts...)
+	if err != nil && restoreDir != "" {
+		task, err = d.discardCheckpoint(cfg, container, restoreDir, err)
+		restoreDir = ""
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error in creating task: %v", err)
 	}
@@ -508,9 +1020,18 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		totalCpuStats:  cpustats.New(d.compute),
 		userCpuStats:   cpustats.New(d.compute),
 		systemCpuStats: cpustats.New(d.compute),
+		client:         d.client,
 		container:      container,
 		containerName:  containerName,
 		task:           task,
+		execConfig:     driverConfig.Exec,
+
+		checkpointOnStop: driverConfig.CheckpointOnStop,
+		signalAll:        driverConfig.SignalAll,
+		started:          make(chan struct{}),
+		preStop:          driverConfig.PreStop.Command,
+		preStopTimeout:   preStopTimeout,
+		preserveRootfs:   driverConfig.PreserveRootfs,
 	}
 
 	driverState := TaskState{
@@ -518,18 +1039,264 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 		ContainerName: containerName,
 		StdoutPath:    cfg.StdoutPath,
 		StderrPath:    cfg.StderrPath,
+		Namespace:     d.namespace,
+		Socket:        containerdSocket,
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
 
+	go h.run(d.ctxContainerd)
+
+	// With runc, the checkpoint is restored when the task is started. If the
+	// restore fails, the task is started afresh instead.
+	if restoreDir != "" {
+		<-h.started
+		if h.startErr != nil {
+			task, err := d.discardCheckpoint(cfg, container, restoreDir, h.startErr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error in creating task: %v", err)
+			}
+			h.task, h.started, h.startErr = task, make(chan struct{}), nil
+			go h.run(d.ctxContainerd)
+		} else {
+			// A checkpoint is only restored once.
+			if err := os.RemoveAll(restoreDir); err != nil {
+				d.logger.Warn("Error in removing checkpoint", "checkpoint", restoreDir, "error", err)
+			}
+			d.emitEvent(cfg, "Task restored from checkpoint", map[string]string{"checkpoint": restoreDir})
+		}
+	}
+
+	// Don't report the task as started until it is ready and its post_start
+	// hook succeeded, so that a task crashing on startup fails StartTask.
+	if err := d.waitStarted(h, startupGrace, &driverConfig, postStartTimeout); err != nil {
+		if cleanupErr := h.cleanup(d.ctxContainerd, true); cleanupErr != nil {
+			d.logger.Warn("Error in cleaning up task which failed to start", "task_id", cfg.ID, "error", cleanupErr)
+		}
+		return nil, nil, fmt.Errorf("Task failed to start: %v", err)
+	}
+
 	d.tasks.Set(cfg.ID, h)
 
-	go h.run(d.ctxContainerd)
+	if hc != nil {
+		go h.runHealthcheck(d.ctx, d.ctxContainerd, hc, d.taskEventEmitter(cfg))
+	}
 	return handle, nil, nil
 }
 
+// discardCheckpoint removes a checkpoint which failed to restore, so that a
+// broken checkpoint doesn't fail every start of the task, and replaces the
+// task of the container with a new one, which doesn't restore it.
+func (d *Driver) discardCheckpoint(cfg *drivers.TaskConfig, container containerd.Container, restoreDir string, restoreErr error) (containerd.Task, error) {
+	d.logger.Warn("Error in restoring task from checkpoint, starting a new task", "task_id", cfg.ID, "error", restoreErr)
+	d.emitEvent(cfg, "Failed to restore task from checkpoint", map[string]string{
+		"checkpoint": restoreDir,
+		"error":      restoreErr.Error(),
+	})
+	if err := os.RemoveAll(restoreDir); err != nil {
+		d.logger.Warn("Error in removing checkpoint", "checkpoint", restoreDir, "error", err)
+	}
+
+	if err := d.deleteTask(container); err != nil {
+		return nil, err
+	}
+	return d.createTask(container, cfg.StdoutPath, cfg.StderrPath)
+}
+
+// waitStarted waits for the task to be ready, if startup_grace is set, and then
+// runs its post_start hook, if any.
+func (d *Driver) waitStarted(h *taskHandle, startupGrace time.Duration, config *TaskConfig, postStartTimeout time.Duration) error {
+	if startupGrace > 0 {
+		if err := h.waitReady(d.ctxContainerd, startupGrace, config.ReadyCommand); err != nil {
+			return err
+		}
+	}
+
+	if len(config.PostStart.Command) == 0 {
+		return nil
+	}
+
+	<-h.started
+	if h.startErr != nil {
+		return fmt.Errorf("Error in starting task: %v", h.startErr)
+	}
+	return h.runHook(d.ctxContainerd, "post_start", config.PostStart.Command, postStartTimeout)
+}
+
+// hookTimeout parses the timeout of a lifecycle hook.
+func hookTimeout(name string, hook *LifecycleHook) (time.Duration, error) {
+	if len(hook.Command) == 0 {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(hook.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse %s timeout: %v", name, err)
+	}
+	return timeout, nil
+}
+
+// cpuLimits returns the CFS quota and period enforcing a hard CPU limit on the
+// task, or a zero quota if the task CPU isn't limited.
+// The quota and period set by Nomad take precedence. Otherwise, if cpu_hard_limit
+// is set, the quota is computed from the task's cpu resources, same as docker:
+// the task can use its share of the node CPU in each period, spread over all cores.
+func cpuLimits(resources *drivers.LinuxResources, config *TaskConfig) (int64, uint64, error) {
+	if resources.CPUQuota > 0 {
+		period := resources.CPUPeriod
+		if period <= 0 {
+			period = defaultCPUCFSPeriod
+		}
+		return resources.CPUQuota, uint64(period), nil
+	}
+
+	if !config.CPUHardLimit {
+		if config.CPUCFSPeriod != 0 {
+			return 0, 0, fmt.Errorf("cpu_hard_limit must be set to true, in order to use cpu_cfs_period.")
+		}
+		return 0, 0, nil
+	}
+
+	// Same bounds as the kernel: 1ms to 1s.
+	if config.CPUCFSPeriod < 0 || (config.CPUCFSPeriod > 0 && config.CPUCFSPeriod < 1000) || config.CPUCFSPeriod > 1000000 {
+		return 0, 0, fmt.Errorf("cpu_cfs_period must be between 1000 and 1000000 microseconds.")
+	}
+
+	period := config.CPUCFSPeriod
+	if period == 0 {
+		period = resources.CPUPeriod
+	}
+	if period <= 0 {
+		period = defaultCPUCFSPeriod
+	}
+
+	quota := int64(resources.PercentTicks*float64(period)) * int64(runtime.NumCPU())
+	if quota <= 0 {
+		return 0, 0, fmt.Errorf("Unable to compute cpu_hard_limit from the task cpu resources.")
+	}
+	return quota, uint64(period), nil
+}
+
+// memorySwap returns the memory+swap limit and the swappiness of the task,
+// given its memory limits. A zero swap limit means the kernel default is used,
+// and -1 means swap is unlimited. A -1 swappiness means the kernel default is used.
+// memory_swap in the task config takes precedence over the plugin default, which
+// is raised to the memory limit of tasks with a higher limit.
+// If swap isn't allowed by the plugin config, the task can't use any swap.
+func (d *Driver) memorySwap(soft, hard int64, config *TaskConfig) (int64, int64, error) {
+	limit := soft
+	if hard > 0 {
+		limit = hard
+	}
+
+	if config.Swappiness != -1 {
+		if config.Swappiness < 0 || config.Swappiness > 100 {
+			return 0, 0, fmt.Errorf("memory_swappiness must be between 0 and 100.")
+		}
+		if cgroups.IsCgroup2UnifiedMode() {
+			return 0, 0, fmt.Errorf("memory_swappiness is not supported with cgroup v2.")
+		}
+	}
+
+	if !d.config.AllowSwap {
+		if config.MemorySwap != "" {
+			return 0, 0, fmt.Errorf("memory_swap is not allowed. Set allow_swap to true in plugin config to allow tasks to use swap.")
+		}
+		swappiness := int64(-1)
+		if !cgroups.IsCgroup2UnifiedMode() {
+			swappiness = 0
+		}
+		return limit, swappiness, nil
+	}
+
+	if config.MemorySwap == "" {
+		if d.config.MemorySwap == "" {
+			return 0, config.Swappiness, nil
+		}
+
+		// The plugin default doesn't fail tasks with a higher memory limit,
+		// which get no swap instead.
+		swap, err := parseMemorySwap(d.config.MemorySwap)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Error in setting memory_swap from plugin config: %v", err)
+		}
+		if swap != -1 && swap < limit {
+			swap = limit
+		}
+		return swap, config.Swappiness, nil
+	}
+
+	swap, err := parseMemorySwap(config.MemorySwap)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error in setting memory_swap: %v", err)
+	}
+	if swap != -1 && swap < limit {
+		return 0, 0, fmt.Errorf("memory_swap (%s) must be greater than or equal to the task memory limit.", config.MemorySwap)
+	}
+	return swap, config.Swappiness, nil
+}
+
+// ulimits returns the resource limits of the task. Limits set in the task config
+// override the defaults set in the plugin config, and are capped by max_ulimit,
+// if set for the same resource.
+func (d *Driver) ulimits(config *TaskConfig) ([]specs.POSIXRlimit, error) {
+	values := make(map[string]string)
+	for name, value := range d.config.Ulimit {
+		values[name] = value
+	}
+	for name, value := range config.Ulimit {
+		values[name] = value
+	}
+
+	var rlimits []specs.POSIXRlimit
+	for name, value := range values {
+		rlimit, err := parseUlimit(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if maxValue, ok := d.config.MaxUlimit[name]; ok {
+			maxLimit, err := parseUlimit(name, maxValue)
+			if err != nil {
+				return nil, err
+			}
+			if rlimit.Hard > maxLimit.Hard || rlimit.Soft > maxLimit.Soft {
+				return nil, fmt.Errorf("%s ulimit %s exceeds the maximum %s set in plugin config.", name, value, maxValue)
+			}
+		}
+		rlimits = append(rlimits, rlimit)
+	}
+
+	sort.Slice(rlimits, func(i, j int) bool { return rlimits[i].Type < rlimits[j].Type })
+	return rlimits, nil
+}
+
+// cpusets returns the CPUs and memory nodes the task is pinned to.
+// CPUs are the cores reserved by Nomad (resources.cores), if any. Otherwise,
+// cpuset_cpus can be set on nodes which don't use Nomad core reservation.
+func cpusets(resources *drivers.LinuxResources, config *TaskConfig) (string, string, error) {
+	cpus := resources.CpusetCpus
+	if config.CpusetCpus != "" {
+		if cpus != "" {
+			return "", "", fmt.Errorf("cpuset_cpus cannot be set, when the task reserves cores with resources.cores.")
+		}
+		if err := validateCPUSet(config.CpusetCpus, onlineCPUsPath, ""); err != nil {
+			return "", "", fmt.Errorf("Error in setting cpuset_cpus: %v", err)
+		}
+		cpus = config.CpusetCpus
+	}
+
+	// Kernels built without NUMA support only have memory node 0, and no
+	// list of online nodes.
+	if config.CpusetMems != "" {
+		if err := validateCPUSet(config.CpusetMems, onlineNodesPath, "0"); err != nil {
+			return "", "", fmt.Errorf("Error in setting cpuset_mems: %v", err)
+		}
+	}
+	return cpus, config.CpusetMems, nil
+}
+
 // skipOverride determines whether the environment variable (key) needs an override or not.
 func skipOverride(key string) bool {
 	skipOverrideList := []string{"PATH"}
@@ -551,11 +1318,26 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return nil
 	}
 
-	var taskState TaskState
-	if err := handle.GetDriverState(&taskState); err != nil {
+	taskState, err := decodeTaskState(handle)
+	if err != nil {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
 
+	if taskState.Namespace != d.namespace || taskState.Socket != containerdSocket {
+		return fmt.Errorf("task was created in containerd namespace %q at %s, but the driver uses namespace %q at %s",
+			taskState.Namespace, taskState.Socket, d.namespace, containerdSocket)
+	}
+
+	var driverConfig TaskConfig
+	if err := handle.Config.DecodeDriverConfig(&driverConfig); err != nil {
+		return fmt.Errorf("failed to decode driver config: %v", err)
+	}
+
+	preStopTimeout, err := hookTimeout("pre_stop", &driverConfig.PreStop)
+	if err != nil {
+		return err
+	}
+
 	container, err := d.loadContainer(taskState.ContainerName)
 	if err != nil {
 		return fmt.Errorf("Error in recovering container: %v", err)
@@ -578,20 +1360,47 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		taskConfig:     handle.Config,
 		procState:      drivers.TaskStateRunning,
 		startedAt:      taskState.StartedAt,
-		exitResult:     &drivers.ExitResult{},
 		logger:         d.logger,
 		totalCpuStats:  cpustats.New(d.compute),
 		userCpuStats:   cpustats.New(d.compute),
 		systemCpuStats: cpustats.New(d.compute),
+		client:         d.client,
 		container:      container,
 		containerName:  taskState.ContainerName,
 		task:           task,
+		execConfig:     driverConfig.Exec,
+
+		checkpointOnStop: driverConfig.CheckpointOnStop,
+		signalAll:        driverConfig.SignalAll,
+		started:          make(chan struct{}),
+		preStop:          driverConfig.PreStop.Command,
+		preStopTimeout:   preStopTimeout,
+		preserveRootfs:   driverConfig.PreserveRootfs,
+	}
+
+	// A task which exited while the Nomad client was down must not be
+	// re-run. Its exit status is reported through WaitTask instead.
+	if status.Status == containerd.Stopped {
+		h.procState = drivers.TaskStateExited
+		h.completedAt = status.ExitTime
+		h.exitResult = &drivers.ExitResult{
+			ExitCode: int(status.ExitStatus),
+		}
 	}
 
 	d.tasks.Set(handle.Config.ID, h)
 
-	if status.Status == containerd.Stopped {
+	// The client went down before the task was started.
+	if status.Status == containerd.Created {
 		go h.run(d.ctxContainerd)
+	} else {
+		close(h.started)
+	}
+
+	if status.Status != containerd.Stopped {
+		if err := d.recoverHealthcheck(h, container, &driverConfig.Healthcheck); err != nil {
+			d.logger.Warn("Error in recovering task healthcheck", "task_id", handle.Config.ID, "error", err)
+		}
 	}
 
 	d.logger.Info(fmt.Sprintf("Task with ID: %s recovered successfully.\n", handle.Config.ID))
@@ -612,20 +1421,36 @@ func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.E
 
 func (d *Driver) handleWait(ctx context.Context, handle *taskHandle, ch chan *drivers.ExitResult) {
 	defer close(ch)
-	var result *drivers.ExitResult
 
-	exitStatusCh, err := handle.task.Wait(d.ctxContainerd)
-	if err != nil {
-		result = &drivers.ExitResult{
-			ExitCode: 255,
-			Err:      fmt.Errorf("executor: error waiting on process: %v", err),
+	// exitResult is only set when recovering a task which exited while the
+	// Nomad client was down, and is never modified afterwards.
+	result := handle.exitResult
+
+	// A task which failed to start never exits.
+	if result == nil {
+		<-handle.started
+		if handle.startErr != nil {
+			result = &drivers.ExitResult{
+				ExitCode: 255,
+				Err:      fmt.Errorf("Error in starting task: %v", handle.startErr),
+			}
 		}
-	} else {
-		status := <-exitStatusCh
-		code, _, err := status.Result()
-		result = &drivers.ExitResult{
-			ExitCode: int(code),
-			Err:      err,
+	}
+
+	if result == nil {
+		exitStatusCh, err := handle.task.Wait(d.ctxContainerd)
+		if err != nil {
+			result = &drivers.ExitResult{
+				ExitCode: 255,
+				Err:      fmt.Errorf("executor: error waiting on process: %v", err),
+			}
+		} else {
+			status := <-exitStatusCh
+			code, _, err := status.Result()
+			result = &drivers.ExitResult{
+				ExitCode: int(code),
+				Err:      err,
+			}
 		}
 	}
 
@@ -647,6 +1472,47 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 		return drivers.ErrTaskNotFound
 	}
 
+	// The pre_stop hook can't exec into a frozen cgroup, so thaw it first.
+	if len(handle.preStop) > 0 {
+		ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+		err := handle.resumeIfPaused(ctxWithTimeout)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Error in resuming task: %v", err)
+		}
+	}
+
+	// The pre_stop hook runs before the task is checkpointed or signalled,
+	// and its duration counts against the kill timeout.
+	if len(handle.preStop) > 0 {
+		start := time.Now()
+		preStopTimeout := handle.preStopTimeout
+		if timeout < preStopTimeout {
+			preStopTimeout = timeout
+		}
+		if err := handle.runHook(d.ctxContainerd, "pre_stop", handle.preStop, preStopTimeout); err != nil {
+			d.logger.Warn("Error in running pre_stop hook", "task_id", taskID, "error", err)
+			d.emitEvent(handle.taskConfig, "pre_stop hook failed", map[string]string{"error": err.Error()})
+		}
+		timeout -= time.Since(start)
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+
+	// Checkpoint the task so it can be restored on the next start.
+	// Fall back to a normal stop if the checkpoint fails.
+	if handle.checkpointOnStop {
+		dir := checkpointDir(handle.taskConfig)
+		if err := handle.checkpoint(d.ctxContainerd, dir); err != nil {
+			d.logger.Warn("Error in checkpointing task, stopping it instead", "task_id", taskID, "error", err)
+			d.emitEvent(handle.taskConfig, "Failed to checkpoint task, stopping it instead", map[string]string{"error": err.Error()})
+		} else {
+			d.emitEvent(handle.taskConfig, "Task checkpointed", map[string]string{"checkpoint": dir})
+			return nil
+		}
+	}
+
 	if err := handle.shutdown(d.ctxContainerd, timeout, syscall.SIGTERM); err != nil {
 		return fmt.Errorf("Shutdown failed: %v", err)
 	}
@@ -661,16 +1527,16 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		return drivers.ErrTaskNotFound
 	}
 
+	// If the task status can't be read (e.g. the task is already gone), still
+	// attempt the cleanup, which tolerates missing resources.
 	isRunning, err := handle.IsRunning(d.ctxContainerd)
 	if err != nil {
-		return err
-	}
-
-	if isRunning && !force {
+		d.logger.Warn("Error in getting task status, cleaning up anyway", "task_id", taskID, "error", err)
+	} else if isRunning && !force {
 		return fmt.Errorf("cannot destroy running task")
 	}
 
-	if err := handle.cleanup(d.ctxContainerd); err != nil {
+	if err := handle.cleanup(d.ctxContainerd, force); err != nil {
 		return err
 	}
 
@@ -714,6 +1580,47 @@ func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, err
 	return d.eventer.TaskEvents(ctx)
 }
 
+// emitEvent emits a task event for the given task.
+func (d *Driver) emitEvent(cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	})
+	if err != nil {
+		d.logger.Warn("Error in emitting task event", "task_id", cfg.ID, "error", err)
+	}
+}
+
+// taskEventEmitter returns a function emitting task events for the given task.
+func (d *Driver) taskEventEmitter(cfg *drivers.TaskConfig) func(string, map[string]string) {
+	return func(message string, annotations map[string]string) {
+		d.emitEvent(cfg, message, annotations)
+	}
+}
+
+// recoverHealthcheck restarts the health probe of a recovered task.
+func (d *Driver) recoverHealthcheck(h *taskHandle, container containerd.Container, config *HealthcheckConfig) error {
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	image, err := container.Image(ctxWithTimeout)
+	if err != nil {
+		return err
+	}
+
+	hc, err := d.buildHealthcheck(image, config)
+	if err != nil || hc == nil {
+		return err
+	}
+
+	go h.runHealthcheck(d.ctx, d.ctxContainerd, hc, d.taskEventEmitter(h.taskConfig))
+	return nil
+}
+
 // SignalTask forwards a signal to a task.
 // This is an optional capability.
 func (d *Driver) SignalTask(taskID string, signal string) error {
@@ -722,6 +1629,15 @@ func (d *Driver) SignalTask(taskID string, signal string) error {
 		return drivers.ErrTaskNotFound
 	}
 
+	// PAUSE and RESUME are not real signals, and are used to freeze and
+	// thaw the container cgroup.
+	switch strings.ToUpper(signal) {
+	case pauseSignal:
+		return handle.pause(d.ctxContainerd)
+	case resumeSignal:
+		return handle.resume(d.ctxContainerd)
+	}
+
 	// The given signal will be forwarded to the target taskID.
 	// Please checkout https://github.com/hashicorp/consul-template/blob/master/signals/signals_unix.go
 	// for a list of supported signals.
@@ -0,0 +1,399 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestDecodeTaskState(t *testing.T) {
+	startedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("version 1", func(t *testing.T) {
+		handle := drivers.NewTaskHandle(1)
+		if err := handle.SetDriverState(&taskStateV1{
+			StartedAt:     startedAt,
+			ContainerName: "redis-1234",
+			StdoutPath:    "/alloc/logs/redis.stdout.0",
+			StderrPath:    "/alloc/logs/redis.stderr.0",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := decodeTaskState(handle)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := &TaskState{
+			StartedAt:     startedAt,
+			ContainerName: "redis-1234",
+			StdoutPath:    "/alloc/logs/redis.stdout.0",
+			StderrPath:    "/alloc/logs/redis.stderr.0",
+			Namespace:     defaultNamespace(),
+			Socket:        containerdSocket,
+		}
+		if !reflect.DeepEqual(state, expected) {
+			t.Errorf("expected %+v, got %+v", expected, state)
+		}
+	})
+
+	t.Run("current version", func(t *testing.T) {
+		expected := &TaskState{
+			StartedAt:     startedAt,
+			ContainerName: "redis-1234",
+			StdoutPath:    "/alloc/logs/redis.stdout.0",
+			StderrPath:    "/alloc/logs/redis.stderr.0",
+			Namespace:     "custom",
+			Socket:        "/var/run/custom/containerd.sock",
+		}
+		handle := drivers.NewTaskHandle(taskHandleVersion)
+		if err := handle.SetDriverState(expected); err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := decodeTaskState(handle)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(state, expected) {
+			t.Errorf("expected %+v, got %+v", expected, state)
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		handle := drivers.NewTaskHandle(taskHandleVersion + 1)
+		if err := handle.SetDriverState(&TaskState{ContainerName: "redis-1234"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := decodeTaskState(handle); err == nil {
+			t.Error("expected an error for an unknown task handle version")
+		}
+	})
+}
+
+func TestDriverUlimits(t *testing.T) {
+	cases := []struct {
+		name      string
+		ulimit    hclutils.MapStrStr
+		maxUlimit hclutils.MapStrStr
+		config    hclutils.MapStrStr
+		expected  []specs.POSIXRlimit
+		err       bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "task ulimits sorted by type",
+			config: hclutils.MapStrStr{"nproc": "512", "memlock": "unlimited"},
+			expected: []specs.POSIXRlimit{
+				{Type: "RLIMIT_MEMLOCK", Soft: ^uint64(0), Hard: ^uint64(0)},
+				{Type: "RLIMIT_NPROC", Soft: 512, Hard: 512},
+			},
+		},
+		{
+			name:   "task ulimits take precedence over plugin ulimits",
+			ulimit: hclutils.MapStrStr{"nofile": "1024", "core": "0"},
+			config: hclutils.MapStrStr{"nofile": "4096:8192"},
+			expected: []specs.POSIXRlimit{
+				{Type: "RLIMIT_CORE", Soft: 0, Hard: 0},
+				{Type: "RLIMIT_NOFILE", Soft: 4096, Hard: 8192},
+			},
+		},
+		{
+			name:      "within max",
+			maxUlimit: hclutils.MapStrStr{"nofile": "8192"},
+			config:    hclutils.MapStrStr{"nofile": "4096:8192"},
+			expected: []specs.POSIXRlimit{
+				{Type: "RLIMIT_NOFILE", Soft: 4096, Hard: 8192},
+			},
+		},
+		{
+			name:      "hard limit above max",
+			maxUlimit: hclutils.MapStrStr{"nofile": "8192"},
+			config:    hclutils.MapStrStr{"nofile": "4096:16384"},
+			err:       true,
+		},
+		{
+			name:      "soft limit above max",
+			maxUlimit: hclutils.MapStrStr{"nofile": "1024:8192"},
+			config:    hclutils.MapStrStr{"nofile": "2048:8192"},
+			err:       true,
+		},
+		{
+			name:      "unlimited above max",
+			maxUlimit: hclutils.MapStrStr{"memlock": "65536"},
+			config:    hclutils.MapStrStr{"memlock": "unlimited"},
+			err:       true,
+		},
+		{
+			name:      "plugin ulimit above max",
+			ulimit:    hclutils.MapStrStr{"nofile": "16384"},
+			maxUlimit: hclutils.MapStrStr{"nofile": "8192"},
+			err:       true,
+		},
+		{
+			name:   "unknown name",
+			config: hclutils.MapStrStr{"files": "1024"},
+			err:    true,
+		},
+		{
+			name:   "soft greater than hard",
+			config: hclutils.MapStrStr{"nofile": "8192:1024"},
+			err:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Driver{config: &Config{Ulimit: tc.ulimit, MaxUlimit: tc.maxUlimit}}
+
+			rlimits, err := d.ulimits(&TaskConfig{Ulimit: tc.config})
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", rlimits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(rlimits, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, rlimits)
+			}
+		})
+	}
+}
+
+func TestCPULimits(t *testing.T) {
+	cpus := int64(runtime.NumCPU())
+
+	cases := []struct {
+		name      string
+		resources drivers.LinuxResources
+		config    TaskConfig
+		quota     int64
+		period    uint64
+		err       bool
+	}{
+		{
+			name:      "no limit",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+		},
+		{
+			name:      "nomad quota",
+			resources: drivers.LinuxResources{CPUQuota: 50000, CPUPeriod: 200000, PercentTicks: 0.5},
+			quota:     50000,
+			period:    200000,
+		},
+		{
+			name:      "nomad quota with default period",
+			resources: drivers.LinuxResources{CPUQuota: 50000},
+			quota:     50000,
+			period:    defaultCPUCFSPeriod,
+		},
+		{
+			name:      "nomad quota takes precedence over cpu_hard_limit",
+			resources: drivers.LinuxResources{CPUQuota: 50000, CPUPeriod: 100000, PercentTicks: 0.25},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 50000},
+			quota:     50000,
+			period:    100000,
+		},
+		{
+			name:      "cpu_hard_limit",
+			resources: drivers.LinuxResources{PercentTicks: 0.25},
+			config:    TaskConfig{CPUHardLimit: true},
+			quota:     25000 * cpus,
+			period:    defaultCPUCFSPeriod,
+		},
+		{
+			name:      "cpu_hard_limit with the nomad period",
+			resources: drivers.LinuxResources{CPUPeriod: 200000, PercentTicks: 0.25},
+			config:    TaskConfig{CPUHardLimit: true},
+			quota:     50000 * cpus,
+			period:    200000,
+		},
+		{
+			name:      "cpu_cfs_period",
+			resources: drivers.LinuxResources{CPUPeriod: 200000, PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 10000},
+			quota:     5000 * cpus,
+			period:    10000,
+		},
+		{
+			name:      "minimum cpu_cfs_period",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 1000},
+			quota:     500 * cpus,
+			period:    1000,
+		},
+		{
+			name:      "maximum cpu_cfs_period",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 1000000},
+			quota:     500000 * cpus,
+			period:    1000000,
+		},
+		{
+			name:      "cpu_cfs_period too low",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 999},
+			err:       true,
+		},
+		{
+			name:      "cpu_cfs_period too high",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: 1000001},
+			err:       true,
+		},
+		{
+			name:      "negative cpu_cfs_period",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUHardLimit: true, CPUCFSPeriod: -1},
+			err:       true,
+		},
+		{
+			name:      "cpu_cfs_period without cpu_hard_limit",
+			resources: drivers.LinuxResources{PercentTicks: 0.5},
+			config:    TaskConfig{CPUCFSPeriod: 50000},
+			err:       true,
+		},
+		{
+			name:   "cpu_hard_limit without cpu resources",
+			config: TaskConfig{CPUHardLimit: true},
+			err:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			quota, period, err := cpuLimits(&tc.resources, &tc.config)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %d and %d", quota, period)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if quota != tc.quota || period != tc.period {
+				t.Errorf("expected %d and %d, got %d and %d", tc.quota, tc.period, quota, period)
+			}
+		})
+	}
+}
+
+func TestDriverMemorySwap(t *testing.T) {
+	const gib = int64(1024 * 1024 * 1024)
+
+	cgroupV2 := cgroups.IsCgroup2UnifiedMode()
+	noSwappiness := int64(0)
+	if cgroupV2 {
+		noSwappiness = -1
+	}
+
+	cases := []struct {
+		name               string
+		allowSwap          bool
+		defaultSwap        string
+		soft, hard         int64
+		swap               string
+		swappiness         int64
+		expected           int64
+		expectedSwappiness int64
+		err                bool
+	}{
+		{name: "kernel default", allowSwap: true, soft: gib, swappiness: -1, expected: 0, expectedSwappiness: -1},
+		{name: "plugin default", allowSwap: true, defaultSwap: "2g", soft: gib, swappiness: -1, expected: 2 * gib, expectedSwappiness: -1},
+		{name: "plugin default below the limit", allowSwap: true, defaultSwap: "2g", soft: 4 * gib, swappiness: -1, expected: 4 * gib, expectedSwappiness: -1},
+		{name: "plugin default below the hard limit", allowSwap: true, defaultSwap: "2g", soft: gib, hard: 3 * gib, swappiness: -1, expected: 3 * gib, expectedSwappiness: -1},
+		{name: "unlimited plugin default", allowSwap: true, defaultSwap: "-1", soft: 4 * gib, swappiness: -1, expected: -1, expectedSwappiness: -1},
+		{name: "task override", allowSwap: true, defaultSwap: "2g", soft: gib, swap: "3g", swappiness: -1, expected: 3 * gib, expectedSwappiness: -1},
+		{name: "unlimited task swap", allowSwap: true, defaultSwap: "2g", soft: gib, swap: "-1", swappiness: -1, expected: -1, expectedSwappiness: -1},
+		{name: "task swap below the limit", allowSwap: true, soft: gib, swap: "512m", swappiness: -1, err: true},
+		{name: "task swap below the hard limit", allowSwap: true, soft: gib, hard: 2 * gib, swap: "1536m", swappiness: -1, err: true},
+		{name: "invalid task swap", allowSwap: true, soft: gib, swap: "lots", swappiness: -1, err: true},
+		{name: "zero task swap", allowSwap: true, soft: gib, swap: "0", swappiness: -1, err: true},
+		{name: "swap not allowed", defaultSwap: "2g", soft: gib, swappiness: -1, expected: gib, expectedSwappiness: noSwappiness},
+		{name: "swap not allowed with hard limit", soft: gib, hard: 2 * gib, swappiness: -1, expected: 2 * gib, expectedSwappiness: noSwappiness},
+		{name: "task swap not allowed", soft: gib, swap: "2g", swappiness: -1, err: true},
+		{name: "swappiness", allowSwap: true, soft: gib, swappiness: 60, expected: 0, expectedSwappiness: 60, err: cgroupV2},
+		{name: "swappiness out of range", allowSwap: true, soft: gib, swappiness: 101, err: true},
+		{name: "negative swappiness", allowSwap: true, soft: gib, swappiness: -2, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Driver{config: &Config{AllowSwap: tc.allowSwap, MemorySwap: tc.defaultSwap}}
+
+			swap, swappiness, err := d.memorySwap(tc.soft, tc.hard, &TaskConfig{MemorySwap: tc.swap, Swappiness: tc.swappiness})
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %d and %d", swap, swappiness)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if swap != tc.expected || swappiness != tc.expectedSwappiness {
+				t.Errorf("expected %d and %d, got %d and %d", tc.expected, tc.expectedSwappiness, swap, swappiness)
+			}
+		})
+	}
+}
+
+func TestTaskConfigSetDevices(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		Devices: []*drivers.DeviceConfig{
+			{HostPath: "/dev/nvidia0", TaskPath: "/dev/nvidia0", Permissions: "rw"},
+			{HostPath: "/dev/nvidia1", TaskPath: "/dev/gpu1"},
+			{HostPath: "/dev/nvidiactl"},
+		},
+	}
+	config := &TaskConfig{Devices: []string{"/dev/fuse"}}
+
+	config.setDevices(cfg)
+
+	expected := []string{
+		"/dev/fuse",
+		"/dev/nvidia0:/dev/nvidia0:rw",
+		"/dev/nvidia1:/dev/gpu1:rwm",
+		"/dev/nvidiactl:/dev/nvidiactl:rwm",
+	}
+	if !reflect.DeepEqual(config.Devices, expected) {
+		t.Errorf("expected %v, got %v", expected, config.Devices)
+	}
+
+	// Devices reserved by Nomad are valid device mappings.
+	for _, device := range config.Devices {
+		if _, _, _, err := parseDevice(device); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
@@ -18,9 +18,11 @@ limitations under the License.
 package containerd
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -29,13 +31,19 @@ import (
 	v2 "github.com/containerd/cgroups/v3/cgroup2/stats"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/oci"
 	"github.com/containerd/typeurl/v2"
 	"github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
+// checkpointTimeout is the time allowed for CRIU to dump the task state.
+const checkpointTimeout = 5 * time.Minute
+
 // taskHandle should store all relevant runtime information
 // such as process ID if this is a local task or other meta
 // data if this driver deals with external APIs
@@ -52,9 +60,39 @@ type taskHandle struct {
 	totalCpuStats  *cpustats.Tracker
 	userCpuStats   *cpustats.Tracker
 	systemCpuStats *cpustats.Tracker
+	client         *containerd.Client
 	containerName  string
 	container      containerd.Container
 	task           containerd.Task
+	execConfig     ExecConfig
+
+	// checkpointOnStop is set if the task should be checkpointed, instead of
+	// being signalled, when stopped.
+	checkpointOnStop bool
+
+	// signalAll is set if signals are sent to all processes in the container,
+	// instead of the init process only.
+	signalAll bool
+
+	// started is closed once run has attempted to start the task, or when
+	// a started task is recovered, and startErr is the error returned by
+	// that attempt, if any.
+	started  chan struct{}
+	startErr error
+
+	// healthLock syncs access to health, which is the result of the task's
+	// healthcheck. It is empty if the task has no healthcheck.
+	healthLock sync.Mutex
+	health     string
+
+	// preStop is the command run inside the container before it is
+	// signalled on stop, and preStopTimeout is the time it is allowed to run.
+	preStop        []string
+	preStopTimeout time.Duration
+
+	// preserveRootfs is set if the container and its snapshot are kept when
+	// the task is destroyed, to be reused when the task restarts.
+	preserveRootfs bool
 }
 
 func (h *taskHandle) TaskStatus(ctxContainerd context.Context) *drivers.TaskStatus {
@@ -63,39 +101,64 @@ func (h *taskHandle) TaskStatus(ctxContainerd context.Context) *drivers.TaskStat
 
 	h.procState = drivers.TaskStateExited
 
-	isRunning, err := h.IsRunning(ctxContainerd)
+	var paused bool
+	status, err := h.status(ctxContainerd)
 	if err != nil {
 		h.procState = drivers.TaskStateUnknown
-	} else if isRunning {
+	} else if isActive(status) {
 		h.procState = drivers.TaskStateRunning
+		paused = status != containerd.Running
+	}
+
+	driverAttributes := map[string]string{
+		"containerName": h.containerName,
+		"paused":        strconv.FormatBool(paused),
+	}
+	if health := h.getHealth(); health != "" {
+		driverAttributes["health"] = health
 	}
 
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.procState,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"containerName": h.containerName,
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.procState,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: driverAttributes,
 	}
 }
 
+// IsRunning returns true if the task is running or paused.
 func (h *taskHandle) IsRunning(ctxContainerd context.Context) (bool, error) {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
+	status, err := h.status(ctxContainerd)
+	if err != nil {
+		return false, err
+	}
+
+	return isActive(status), nil
+}
+
+// status returns the containerd status of the task.
+func (h *taskHandle) status(ctxContainerd context.Context) (containerd.ProcessStatus, error) {
 	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
 	defer cancel()
 
 	status, err := h.task.Status(ctxWithTimeout)
 	if err != nil {
-		return false, fmt.Errorf("Error in getting task status: %v", err)
+		return containerd.Unknown, fmt.Errorf("Error in getting task status: %w", err)
 	}
 
-	return (status.Status == containerd.Running), nil
+	return status.Status, nil
+}
+
+// isActive returns true if the task process is alive, which includes
+// tasks with a frozen cgroup.
+func isActive(status containerd.ProcessStatus) bool {
+	return status == containerd.Running || status == containerd.Paused || status == containerd.Pausing
 }
 
 func (h *taskHandle) run(ctxContainerd context.Context) {
@@ -106,22 +169,24 @@ func (h *taskHandle) run(ctxContainerd context.Context) {
 	// TODO: Use goroutine and a channel to synchronize this, instead of sleep.
 	time.Sleep(5 * time.Second)
 
-	h.task.Start(ctxContainerd)
+	if err := h.task.Start(ctxContainerd); err != nil {
+		h.logger.Error("Error in starting task", "container", h.containerName, "error", err)
+		h.startErr = err
+	}
+	close(h.started)
 }
 
 // exec launches a new process in a running container.
+// The process is killed if ctx is cancelled before it exits.
 func (h *taskHandle) exec(ctx, ctxContainerd context.Context, taskID string, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
 	defer opts.Stdout.Close()
 	defer opts.Stderr.Close()
 
-	spec, err := h.container.Spec(ctxContainerd)
+	spec, err := h.execSpec(ctxContainerd, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	pspec := spec.Process
-	pspec.Terminal = opts.Tty
-	pspec.Args = opts.Command
 	execID, err := uuid.GenerateUUID()
 	if err != nil {
 		return nil, err
@@ -133,63 +198,206 @@ func (h *taskHandle) exec(ctx, ctxContainerd context.Context, taskID string, opt
 	}
 	ioCreator := cio.NewCreator(cioOpts...)
 
-	process, err := h.task.Exec(ctxContainerd, execID[:8], pspec, ioCreator)
+	process, err := h.task.Exec(ctxContainerd, execID[:8], spec.Process, ioCreator)
+	if err != nil {
+		return nil, err
+	}
+	defer process.Delete(ctxContainerd)
+
+	statusC, err := process.Wait(ctxContainerd)
 	if err != nil {
 		return nil, err
 	}
+
+	if err := process.Start(ctxContainerd); err != nil {
+		return nil, err
+	}
+
+	// Stop forwarding terminal resize events once the process has exited.
+	resizeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	go func() {
 		for {
 			select {
+			case <-resizeCtx.Done():
+				return
 			case s, ok := <-opts.ResizeCh:
 				if !ok {
 					return
 				}
-				if err = h.task.Resize(ctxContainerd, uint32(s.Width), uint32(s.Height)); err != nil {
+				if err := process.Resize(ctxContainerd, uint32(s.Width), uint32(s.Height)); err != nil {
 					h.logger.Error("Failed to resize terminal", "error", err)
 					return
 				}
-                        }
+			}
 		}
 	}()
 
-	defer process.Delete(ctxContainerd)
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-ctx.Done():
+		h.logger.Debug("Exec session cancelled, killing exec process", "exec_id", process.ID())
+		// The process may have exited meanwhile, its exit status is still read.
+		if err := process.Kill(ctxContainerd, syscall.SIGKILL); err != nil && !errdefs.IsNotFound(err) {
+			return nil, fmt.Errorf("Error in killing exec process: %v", err)
+		}
+		status = <-statusC
+	}
 
-	statusC, err := process.Wait(ctxContainerd)
+	code, _, err := status.Result()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := process.Start(ctxContainerd); err != nil {
-		return nil, err
+	return &drivers.ExitResult{
+		ExitCode: int(code),
+	}, nil
+}
+
+// execCommand runs cmd inside the container until it exits or ctx is cancelled,
+// and returns its exit result along with its output.
+func (h *taskHandle) execCommand(ctx, ctxContainerd context.Context, cmd []string) (*drivers.ExitResult, string, error) {
+	var stdout, stderr bytes.Buffer
+	result, err := h.exec(ctx, ctxContainerd, h.taskConfig.ID, &drivers.ExecOptions{
+		Command: cmd,
+		Stdout:  nopWriteCloser{&stdout},
+		Stderr:  nopWriteCloser{&stderr},
+	})
+	if err != nil {
+		return nil, "", err
 	}
+	return result, stdout.String() + stderr.String(), nil
+}
+
+// runHook runs a lifecycle hook command inside the container, and fails if the
+// command doesn't exit successfully within timeout.
+func (h *taskHandle) runHook(ctxContainerd context.Context, name string, command []string, timeout time.Duration) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, timeout)
+	defer cancel()
 
-	var code uint32
-	status := <-statusC
-	code, _, err = status.Result()
+	result, output, err := h.execCommand(ctxWithTimeout, ctxContainerd, command)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("Error in running %s hook: %v", name, err)
+	}
+	if ctxWithTimeout.Err() != nil {
+		return fmt.Errorf("%s hook timed out after %v", name, timeout)
+	}
+	if !result.Successful() {
+		return fmt.Errorf("%s hook exited with code %d: %s", name, result.ExitCode, output)
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
+	h.logger.Debug("Lifecycle hook succeeded", "container", h.containerName, "hook", name)
+	return nil
+}
+
+// waitReady waits for the task to be ready after it is started. The task is
+// ready once it has stayed up for the whole grace period or, if readyCommand
+// is set, once readyCommand succeeds within the grace period.
+// The grace period starts once the task process is started.
+func (h *taskHandle) waitReady(ctxContainerd context.Context, grace time.Duration, readyCommand []string) error {
+	exitCh, err := h.task.Wait(ctxContainerd)
+	if err != nil {
+		return fmt.Errorf("Error in waiting on task: %v", err)
+	}
+
+	<-h.started
+	if h.startErr != nil {
+		return fmt.Errorf("Error in starting task: %v", h.startErr)
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, grace)
+	defer cancel()
+
+	var probeCh <-chan time.Time
+	if len(readyCommand) > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		probeCh = ticker.C
+	}
+
+	for {
+		select {
+		case status := <-exitCh:
+			code, _, _ := status.Result()
+			err := fmt.Errorf("task exited with code %d during startup_grace", code)
+			if stderr := tailLog(h.taskConfig.TaskDir().LogDir, h.taskConfig.Name+".stderr", 10); stderr != "" {
+				err = fmt.Errorf("%v, last stderr lines:\n%s", err, stderr)
+			}
+			return err
+		case <-ctxWithTimeout.Done():
+			if len(readyCommand) > 0 {
+				return fmt.Errorf("ready_command did not succeed within startup_grace")
+			}
+			return nil
+		case <-probeCh:
+			result, output, err := h.execCommand(ctxWithTimeout, ctxContainerd, readyCommand)
+			if err != nil {
+				h.logger.Debug("Error in running ready_command", "container", h.containerName, "error", err)
+				continue
 			}
+			if result.Successful() {
+				return nil
+			}
+			h.logger.Debug("ready_command failed", "container", h.containerName, "exit_code", result.ExitCode, "output", output)
 		}
-	}()
+	}
+}
 
-	return &drivers.ExitResult{
-		ExitCode: int(code),
-	}, nil
+// execSpec builds the process spec for an exec session from the container
+// spec, applying the exec defaults set in the task config.
+func (h *taskHandle) execSpec(ctxContainerd context.Context, opts *drivers.ExecOptions) (*oci.Spec, error) {
+	spec, err := h.container.Spec(ctxContainerd)
+	if err != nil {
+		return nil, err
+	}
+
+	spec.Process.Terminal = opts.Tty
+	spec.Process.Args = opts.Command
+
+	var specOpts []oci.SpecOpts
+	if h.execConfig.User != "" {
+		specOpts = append(specOpts, oci.WithUser(h.execConfig.User))
+	}
+	if len(h.execConfig.Env) > 0 {
+		var env []string
+		for key, val := range h.execConfig.Env {
+			env = append(env, fmt.Sprintf("%s=%s", key, val))
+		}
+		specOpts = append(specOpts, oci.WithEnv(env))
+	}
+	if h.execConfig.Cwd != "" {
+		specOpts = append(specOpts, oci.WithProcessCwd(h.execConfig.Cwd))
+	}
+
+	if len(specOpts) == 0 {
+		return spec, nil
+	}
+
+	info, err := h.container.Info(ctxContainerd)
+	if err != nil {
+		return nil, err
+	}
 
+	for _, o := range specOpts {
+		if err := o(ctxContainerd, h.client, &info, spec); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
 }
 
 func (h *taskHandle) shutdown(ctxContainerd context.Context, timeout time.Duration, signal syscall.Signal) error {
 	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
 	defer cancel()
 
-	if err := h.task.Kill(ctxWithTimeout, signal); err != nil {
+	// Signals are not delivered to a frozen cgroup, so thaw it first.
+	if err := h.resumeIfPaused(ctxWithTimeout); err != nil {
+		return err
+	}
+
+	if err := h.task.Kill(ctxWithTimeout, signal, h.killOpts()...); err != nil {
 		return err
 	}
 
@@ -208,22 +416,82 @@ func (h *taskHandle) shutdown(ctxContainerd context.Context, timeout time.Durati
 		return nil
 	}
 
-	return h.task.Kill(ctxWithTimeout, syscall.SIGKILL)
+	return h.task.Kill(ctxWithTimeout, syscall.SIGKILL, h.killOpts()...)
 }
 
-func (h *taskHandle) cleanup(ctxContainerd context.Context) error {
-	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
+// checkpoint dumps the task state into dir using CRIU. The task exits once
+// the checkpoint is taken.
+func (h *taskHandle) checkpoint(ctxContainerd context.Context, dir string) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, checkpointTimeout)
 	defer cancel()
 
-	if _, err := h.task.Delete(ctxWithTimeout); err != nil {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
-	if err := h.container.Delete(ctxWithTimeout, containerd.WithSnapshotCleanup); err != nil {
+
+	if _, err := h.task.Checkpoint(ctxWithTimeout, containerd.WithCheckpointImagePath(dir), withCheckpointExit); err != nil {
+		os.RemoveAll(dir)
 		return err
 	}
 	return nil
 }
 
+// cleanup deletes the task, the container and its snapshot (unless the rootfs
+// is preserved), and the generated etc_hosts file. Resources which are already
+// gone are skipped, and every step is attempted even if a previous one failed,
+// so that a retry can finish the job.
+func (h *taskHandle) cleanup(ctxContainerd context.Context, force bool) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	var mErr multierror.Error
+
+	// When forced, kill all processes in the container and wait for them
+	// to exit before deleting it.
+	var deleteOpts []containerd.ProcessDeleteOpts
+	if force {
+		if err := h.resumeIfPaused(ctxWithTimeout); err != nil && !errdefs.IsNotFound(err) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Error in resuming task: %v", err))
+		}
+		deleteOpts = append(deleteOpts, containerd.WithProcessKill)
+	}
+
+	if _, err := h.task.Delete(ctxWithTimeout, deleteOpts...); err != nil && !errdefs.IsNotFound(err) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Error in deleting task: %v", err))
+	}
+
+	// The container is reused by the next run of the task. It is removed
+	// along with its snapshot once the allocation is garbage collected.
+	if h.preserveRootfs {
+		return mErr.ErrorOrNil()
+	}
+
+	// Look up the snapshot before the container metadata is gone.
+	snapshotter, snapshotKey := containerd.DefaultSnapshotter, snapshotName(h.containerName)
+	if info, err := h.container.Info(ctxWithTimeout); err == nil {
+		snapshotter, snapshotKey = info.Snapshotter, info.SnapshotKey
+	}
+
+	// The snapshot is only removed once the container is gone, so that the
+	// rootfs of a container which failed to be deleted is left intact.
+	if err := h.container.Delete(ctxWithTimeout); err != nil && !errdefs.IsNotFound(err) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Error in deleting container: %v", err))
+	} else if snapshotKey != "" {
+		if err := h.client.SnapshotService(snapshotter).Remove(ctxWithTimeout, snapshotKey); err != nil && !errdefs.IsNotFound(err) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Error in deleting snapshot: %v", err))
+		}
+	}
+
+	if err := os.Remove(hostsFilePath(h.taskConfig.TaskDir().LocalDir)); err != nil && !os.IsNotExist(err) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Error in deleting etc_hosts: %v", err))
+	}
+
+	return mErr.ErrorOrNil()
+}
+
 func (h *taskHandle) stats(ctx, ctxContainerd context.Context, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
 	ch := make(chan *drivers.TaskResourceUsage)
 
@@ -337,5 +605,44 @@ func (h *taskHandle) signal(ctxContainerd context.Context, sig os.Signal) error
 	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
 	defer cancel()
 
-	return h.task.Kill(ctxWithTimeout, sig.(syscall.Signal))
+	return h.task.Kill(ctxWithTimeout, sig.(syscall.Signal), h.killOpts()...)
+}
+
+// killOpts returns the options used when signalling the task.
+func (h *taskHandle) killOpts() []containerd.KillOpts {
+	if h.signalAll {
+		return []containerd.KillOpts{containerd.WithKillAll}
+	}
+	return nil
+}
+
+// pause freezes all processes in the container without stopping them.
+func (h *taskHandle) pause(ctxContainerd context.Context) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	return h.task.Pause(ctxWithTimeout)
+}
+
+// resume thaws a paused container.
+func (h *taskHandle) resume(ctxContainerd context.Context) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	return h.task.Resume(ctxWithTimeout)
+}
+
+// resumeIfPaused thaws the container if it is paused, and is a no-op otherwise.
+func (h *taskHandle) resumeIfPaused(ctxContainerd context.Context) error {
+	status, err := h.task.Status(ctxContainerd)
+	if err != nil {
+		return err
+	}
+
+	if status.Status != containerd.Paused && status.Status != containerd.Pausing {
+		return nil
+	}
+
+	h.logger.Info("Resuming paused task before signalling", "container", h.containerName)
+	return h.task.Resume(ctxContainerd)
 }
@@ -0,0 +1,302 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+)
+
+const (
+	// Health states reported in the task's driver attributes.
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+
+	// Defaults for healthcheck settings, same as docker.
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+
+	// healthRestartTimeout is the time an unhealthy task is given to exit
+	// after SIGTERM, before it is killed.
+	healthRestartTimeout = 5 * time.Second
+)
+
+// healthcheck is the resolved configuration of a task's health probe.
+type healthcheck struct {
+	command      []string
+	interval     time.Duration
+	timeout      time.Duration
+	startPeriod  time.Duration
+	retries      int
+	restartAfter int
+}
+
+// imageHealthcheck is the HEALTHCHECK set in a docker image config.
+// Durations are encoded in nanoseconds.
+type imageHealthcheck struct {
+	Test        []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+}
+
+// getImageHealthcheck returns the HEALTHCHECK declared in the image config,
+// or nil if the image doesn't declare one.
+func getImageHealthcheck(ctx context.Context, image containerd.Image) (*imageHealthcheck, error) {
+	desc, err := image.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := content.ReadBlob(ctx, image.ContentStore(), desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Config struct {
+			Healthcheck *imageHealthcheck
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, err
+	}
+	return config.Config.Healthcheck, nil
+}
+
+// buildHealthcheck resolves the health probe of a task from the healthcheck
+// block in the task config, and the HEALTHCHECK declared in the image.
+// Settings from the task config take precedence over the image ones.
+// It returns nil if the task has no health probe.
+func (d *Driver) buildHealthcheck(image containerd.Image, config *HealthcheckConfig) (*healthcheck, error) {
+	if config.Disable {
+		return nil, nil
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	imageHC, err := getImageHealthcheck(ctxWithTimeout, image)
+	if err != nil {
+		return nil, fmt.Errorf("Error in reading image healthcheck: %v", err)
+	}
+	return resolveHealthcheck(imageHC, config)
+}
+
+// resolveHealthcheck merges the healthcheck block of the task config onto the
+// image HEALTHCHECK, if any, and returns nil if neither sets a command.
+func resolveHealthcheck(imageHC *imageHealthcheck, config *HealthcheckConfig) (*healthcheck, error) {
+	hc := &healthcheck{
+		interval:     defaultHealthInterval,
+		timeout:      defaultHealthTimeout,
+		retries:      defaultHealthRetries,
+		restartAfter: config.RestartAfterFailures,
+	}
+
+	if imageHC != nil {
+		command, err := healthcheckCommand(imageHC.Test)
+		if err != nil {
+			return nil, err
+		}
+		hc.command = command
+		if imageHC.Interval > 0 {
+			hc.interval = imageHC.Interval
+		}
+		if imageHC.Timeout > 0 {
+			hc.timeout = imageHC.Timeout
+		}
+		if imageHC.StartPeriod > 0 {
+			hc.startPeriod = imageHC.StartPeriod
+		}
+		if imageHC.Retries > 0 {
+			hc.retries = imageHC.Retries
+		}
+	}
+
+	if len(config.Command) > 0 {
+		hc.command = config.Command
+	}
+	if len(hc.command) == 0 {
+		return nil, nil
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"interval", config.Interval, &hc.interval},
+		{"timeout", config.Timeout, &hc.timeout},
+		{"start_period", config.StartPeriod, &hc.startPeriod},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse healthcheck %s: %v", duration.name, err)
+		}
+		*duration.dest = v
+	}
+	if hc.interval <= 0 || hc.timeout <= 0 {
+		return nil, fmt.Errorf("healthcheck interval and timeout must be greater than zero.")
+	}
+
+	if config.Retries > 0 {
+		hc.retries = config.Retries
+	}
+	return hc, nil
+}
+
+// healthcheckCommand converts a docker HEALTHCHECK test to the command to
+// execute in the container. A NONE test disables the healthcheck.
+func healthcheckCommand(test []string) ([]string, error) {
+	if len(test) == 0 {
+		return nil, nil
+	}
+
+	switch test[0] {
+	case "NONE":
+		return nil, nil
+	case "CMD":
+		return test[1:], nil
+	case "CMD-SHELL":
+		if len(test) != 2 {
+			return nil, fmt.Errorf("Invalid CMD-SHELL healthcheck: %v", test)
+		}
+		return []string{"/bin/sh", "-c", test[1]}, nil
+	default:
+		return nil, fmt.Errorf("Invalid healthcheck test: %v", test)
+	}
+}
+
+// runHealthcheck periodically executes the health probe in the container
+// until the task exits or ctx is cancelled. The task is unhealthy after
+// hc.retries consecutive failures, and is stopped (so that Nomad restarts it)
+// after hc.restartAfter consecutive failures, if set.
+// Failures during the start period are not counted, until the task is
+// healthy for the first time, and probes are skipped while the task is paused.
+func (h *taskHandle) runHealthcheck(ctx, ctxContainerd context.Context, hc *healthcheck, emitEvent func(string, map[string]string)) {
+	exitCh, err := h.task.Wait(ctxContainerd)
+	if err != nil {
+		h.logger.Error("Error in waiting on task, healthcheck is disabled", "container", h.containerName, "error", err)
+		return
+	}
+
+	h.setHealth(healthStarting)
+	startedAt := time.Now()
+	failures := 0
+
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exitCh:
+			return
+		case <-ticker.C:
+		}
+
+		// Probes can't run in a frozen cgroup, so the health of a paused task
+		// is left as is until it is resumed.
+		if h.isPaused(ctxContainerd) {
+			continue
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, hc.timeout)
+		result, output, err := h.execCommand(probeCtx, ctxContainerd, hc.command)
+		cancel()
+
+		if err == nil && result.Successful() {
+			failures = 0
+			if h.setHealth(healthHealthy) {
+				emitEvent("Task is healthy", nil)
+			}
+			continue
+		}
+
+		// Don't count a probe which failed because the task was paused meanwhile.
+		if h.isPaused(ctxContainerd) {
+			continue
+		}
+
+		if time.Since(startedAt) < hc.startPeriod && h.getHealth() == healthStarting {
+			continue
+		}
+
+		failures++
+		annotations := map[string]string{
+			"failures": strconv.Itoa(failures),
+			"output":   output,
+		}
+		if err != nil {
+			annotations["error"] = err.Error()
+		}
+		h.logger.Debug("Healthcheck failed", "container", h.containerName, "failures", failures, "output", output, "error", err)
+
+		if failures >= hc.retries && h.setHealth(healthUnhealthy) {
+			emitEvent("Task is unhealthy", annotations)
+		}
+
+		if hc.restartAfter > 0 && failures >= hc.restartAfter {
+			emitEvent("Restarting unhealthy task", annotations)
+			if err := h.shutdown(ctxContainerd, healthRestartTimeout, syscall.SIGTERM); err != nil {
+				h.logger.Error("Error in stopping unhealthy task", "container", h.containerName, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// isPaused returns true if the task is paused, or being paused.
+func (h *taskHandle) isPaused(ctxContainerd context.Context) bool {
+	status, err := h.status(ctxContainerd)
+	return err == nil && (status == containerd.Paused || status == containerd.Pausing)
+}
+
+// setHealth sets the health of the task, and returns true if it changed.
+func (h *taskHandle) setHealth(health string) bool {
+	h.healthLock.Lock()
+	defer h.healthLock.Unlock()
+
+	changed := h.health != health
+	h.health = health
+	return changed
+}
+
+// getHealth returns the health of the task, or an empty string if the task
+// has no healthcheck.
+func (h *taskHandle) getHealth() string {
+	h.healthLock.Lock()
+	defer h.healthLock.Unlock()
+
+	return h.health
+}
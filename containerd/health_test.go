@@ -0,0 +1,179 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthcheckCommand(t *testing.T) {
+	cases := []struct {
+		name     string
+		test     []string
+		expected []string
+		err      bool
+	}{
+		{name: "empty"},
+		{name: "none", test: []string{"NONE"}},
+		{name: "cmd", test: []string{"CMD", "curl", "-f", "http://localhost"}, expected: []string{"curl", "-f", "http://localhost"}},
+		{name: "cmd-shell", test: []string{"CMD-SHELL", "curl -f http://localhost || exit 1"}, expected: []string{"/bin/sh", "-c", "curl -f http://localhost || exit 1"}},
+		{name: "cmd-shell without command", test: []string{"CMD-SHELL"}, err: true},
+		{name: "cmd-shell with too many args", test: []string{"CMD-SHELL", "curl", "-f"}, err: true},
+		{name: "unknown test", test: []string{"curl", "-f", "http://localhost"}, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			command, err := healthcheckCommand(tc.test)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(command, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, command)
+			}
+		})
+	}
+}
+
+func TestResolveHealthcheck(t *testing.T) {
+	imageHC := &imageHealthcheck{
+		Test:        []string{"CMD", "/healthz"},
+		Interval:    10 * time.Second,
+		Timeout:     5 * time.Second,
+		StartPeriod: time.Minute,
+		Retries:     5,
+	}
+
+	cases := []struct {
+		name     string
+		imageHC  *imageHealthcheck
+		config   HealthcheckConfig
+		expected *healthcheck
+		err      bool
+	}{
+		{
+			name: "no healthcheck",
+		},
+		{
+			name:    "image healthcheck",
+			imageHC: imageHC,
+			expected: &healthcheck{
+				command:     []string{"/healthz"},
+				interval:    10 * time.Second,
+				timeout:     5 * time.Second,
+				startPeriod: time.Minute,
+				retries:     5,
+			},
+		},
+		{
+			name:    "image healthcheck disabled with NONE",
+			imageHC: &imageHealthcheck{Test: []string{"NONE"}, Interval: 10 * time.Second},
+		},
+		{
+			name:   "task healthcheck with defaults",
+			config: HealthcheckConfig{Command: []string{"/bin/check"}},
+			expected: &healthcheck{
+				command:  []string{"/bin/check"},
+				interval: defaultHealthInterval,
+				timeout:  defaultHealthTimeout,
+				retries:  defaultHealthRetries,
+			},
+		},
+		{
+			name:    "task settings override the image",
+			imageHC: imageHC,
+			config: HealthcheckConfig{
+				Command:              []string{"/bin/check"},
+				Interval:             "1s",
+				Retries:              2,
+				RestartAfterFailures: 4,
+			},
+			expected: &healthcheck{
+				command:      []string{"/bin/check"},
+				interval:     time.Second,
+				timeout:      5 * time.Second,
+				startPeriod:  time.Minute,
+				retries:      2,
+				restartAfter: 4,
+			},
+		},
+		{
+			name:    "task settings apply to the image command",
+			imageHC: imageHC,
+			config:  HealthcheckConfig{Timeout: "2s", StartPeriod: "0s"},
+			expected: &healthcheck{
+				command:  []string{"/healthz"},
+				interval: 10 * time.Second,
+				timeout:  2 * time.Second,
+				retries:  5,
+			},
+		},
+		{
+			name:    "task command replaces a NONE image healthcheck",
+			imageHC: &imageHealthcheck{Test: []string{"NONE"}},
+			config:  HealthcheckConfig{Command: []string{"/bin/check"}},
+			expected: &healthcheck{
+				command:  []string{"/bin/check"},
+				interval: defaultHealthInterval,
+				timeout:  defaultHealthTimeout,
+				retries:  defaultHealthRetries,
+			},
+		},
+		{
+			name:    "invalid image test",
+			imageHC: &imageHealthcheck{Test: []string{"CMD-SHELL", "a", "b"}},
+			err:     true,
+		},
+		{
+			name:   "invalid interval",
+			config: HealthcheckConfig{Command: []string{"/bin/check"}, Interval: "often"},
+			err:    true,
+		},
+		{
+			name:   "zero timeout",
+			config: HealthcheckConfig{Command: []string{"/bin/check"}, Timeout: "0s"},
+			err:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc, err := resolveHealthcheck(tc.imageHC, &tc.config)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", hc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(hc, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, hc)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/oci"
+	"github.com/docker/go-units"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// hugepagesDir lists the hugepage sizes supported by the node, as
+// hugepages-<size>kB directories.
+const hugepagesDir = "/sys/kernel/mm/hugepages"
+
+// hugepagePool is the pool of hugepages of a given size on the node.
+type hugepagePool struct {
+	total int64
+	free  int64
+}
+
+// hugepagePools returns the hugepage pools of the node, read from dir e.g.
+// /sys/kernel/mm/hugepages, keyed by page size name e.g. 2MB, as used by the
+// hugetlb cgroup controller.
+func hugepagePools(dir string) (map[string]hugepagePool, error) {
+	dirs, err := filepath.Glob(filepath.Join(dir, "hugepages-*kB"))
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make(map[string]hugepagePool)
+	for _, dir := range dirs {
+		sizeKB, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir), "hugepages-"), "kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		total, err := readInt(filepath.Join(dir, "nr_hugepages"))
+		if err != nil {
+			return nil, err
+		}
+		free, err := readInt(filepath.Join(dir, "free_hugepages"))
+		if err != nil {
+			return nil, err
+		}
+		pools[pageSizeName(sizeKB*1024)] = hugepagePool{total: total, free: free}
+	}
+	return pools, nil
+}
+
+// pageSizeName returns the name of a page size as used by the hugetlb cgroup
+// controller e.g. 2MB or 1GB.
+func pageSizeName(size int64) string {
+	suffixes := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for size >= 1024 && size%1024 == 0 && i < len(suffixes)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%d%s", size, suffixes[i])
+}
+
+// readInt reads a file holding a single integer.
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// buildHugepageLimits converts the hugepages map of the task config (page size
+// to limit e.g. "2MB" = "1GB") to hugetlb limits. Page sizes must be supported
+// by the node, according to the hugepage pools in dir.
+func buildHugepageLimits(hugepages map[string]string, dir string) ([]specs.LinuxHugepageLimit, error) {
+	if len(hugepages) == 0 {
+		return nil, nil
+	}
+
+	pools, err := hugepagePools(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error in reading hugepage sizes: %v", err)
+	}
+
+	var limits []specs.LinuxHugepageLimit
+	for size, value := range hugepages {
+		sizeBytes, err := units.RAMInBytes(size)
+		if err != nil || sizeBytes <= 0 {
+			return nil, fmt.Errorf("Invalid hugepage size %q", size)
+		}
+		pageSize := pageSizeName(sizeBytes)
+		if _, ok := pools[pageSize]; !ok {
+			return nil, fmt.Errorf("Hugepage size %s is not supported by the node", size)
+		}
+
+		limit, err := units.RAMInBytes(value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid %s hugepages limit %q", size, value)
+		}
+		if limit%sizeBytes != 0 {
+			return nil, fmt.Errorf("%s hugepages limit %s must be a multiple of the page size", size, value)
+		}
+
+		limits = append(limits, specs.LinuxHugepageLimit{
+			Pagesize: pageSize,
+			Limit:    uint64(limit),
+		})
+	}
+
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Pagesize < limits[j].Pagesize })
+	return limits, nil
+}
+
+// hugetlbfsMount returns a hugetlbfs mount at target. If the task uses a single
+// hugepage size, the filesystem uses that page size. Otherwise, it uses the
+// default hugepage size of the node.
+func hugetlbfsMount(target string, limits []specs.LinuxHugepageLimit) specs.Mount {
+	options := []string{"nosuid", "nodev", "rw"}
+	if len(limits) == 1 {
+		options = append(options, "pagesize="+strings.TrimSuffix(limits[0].Pagesize, "B"))
+	}
+	return buildMountpoint("hugetlbfs", target, "hugetlbfs", options)
+}
+
+// WithHugepageLimits sets the hugetlb limits of the container.
+func WithHugepageLimits(limits []specs.LinuxHugepageLimit) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			s.Linux.Resources.HugepageLimits = limits
+		}
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// testHugepagesDir has a pool of 512 2MB hugepages (128 free), and a pool of
+// 4 1GB hugepages.
+var testHugepagesDir = filepath.Join("testdata", "hugepages")
+
+func TestPageSizeName(t *testing.T) {
+	cases := map[int64]string{
+		512:                     "512B",
+		64 * 1024:               "64KB",
+		2 * 1024 * 1024:         "2MB",
+		1024 * 1024 * 1024:      "1GB",
+		16 * 1024 * 1024 * 1024: "16GB",
+		1536 * 1024:             "1536KB",
+	}
+
+	for size, expected := range cases {
+		if name := pageSizeName(size); name != expected {
+			t.Errorf("expected %s for %d, got %s", expected, size, name)
+		}
+	}
+}
+
+func TestHugepagePools(t *testing.T) {
+	pools, err := hugepagePools(testHugepagesDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]hugepagePool{
+		"2MB": {total: 512, free: 128},
+		"1GB": {total: 4, free: 4},
+	}
+	if !reflect.DeepEqual(pools, expected) {
+		t.Errorf("expected %+v, got %+v", expected, pools)
+	}
+}
+
+func TestBuildHugepageLimits(t *testing.T) {
+	cases := []struct {
+		name      string
+		hugepages map[string]string
+		expected  []specs.LinuxHugepageLimit
+		err       bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:      "2MB pages",
+			hugepages: map[string]string{"2MB": "1GB"},
+			expected:  []specs.LinuxHugepageLimit{{Pagesize: "2MB", Limit: 1024 * 1024 * 1024}},
+		},
+		{
+			name:      "page size in lower case",
+			hugepages: map[string]string{"2mb": "4mb"},
+			expected:  []specs.LinuxHugepageLimit{{Pagesize: "2MB", Limit: 4 * 1024 * 1024}},
+		},
+		{
+			name:      "1GB pages",
+			hugepages: map[string]string{"1GB": "2GB"},
+			expected:  []specs.LinuxHugepageLimit{{Pagesize: "1GB", Limit: 2 * 1024 * 1024 * 1024}},
+		},
+		{
+			name:      "both page sizes",
+			hugepages: map[string]string{"2MB": "64MB", "1GB": "1GB"},
+			expected: []specs.LinuxHugepageLimit{
+				{Pagesize: "1GB", Limit: 1024 * 1024 * 1024},
+				{Pagesize: "2MB", Limit: 64 * 1024 * 1024},
+			},
+		},
+		{name: "limit not a multiple of the page size", hugepages: map[string]string{"2MB": "3MB"}, err: true},
+		{name: "unsupported page size", hugepages: map[string]string{"16MB": "64MB"}, err: true},
+		{name: "invalid page size", hugepages: map[string]string{"huge": "64MB"}, err: true},
+		{name: "invalid limit", hugepages: map[string]string{"2MB": "lots"}, err: true},
+		{name: "zero limit", hugepages: map[string]string{"2MB": "0"}, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			limits, err := buildHugepageLimits(tc.hugepages, testHugepagesDir)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", limits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(limits, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, limits)
+			}
+		})
+	}
+}
+
+func TestHugetlbfsMount(t *testing.T) {
+	single := hugetlbfsMount("/dev/hugepages", []specs.LinuxHugepageLimit{{Pagesize: "2MB", Limit: 1024 * 1024 * 1024}})
+	expected := specs.Mount{
+		Type:        "hugetlbfs",
+		Source:      "hugetlbfs",
+		Destination: "/dev/hugepages",
+		Options:     []string{"nosuid", "nodev", "rw", "pagesize=2M"},
+	}
+	if !reflect.DeepEqual(single, expected) {
+		t.Errorf("expected %+v, got %+v", expected, single)
+	}
+
+	// With several page sizes, the default hugepage size of the node is used.
+	multiple := hugetlbfsMount("/dev/hugepages", []specs.LinuxHugepageLimit{
+		{Pagesize: "1GB", Limit: 1024 * 1024 * 1024},
+		{Pagesize: "2MB", Limit: 1024 * 1024 * 1024},
+	})
+	if expected := []string{"nosuid", "nodev", "rw"}; !reflect.DeepEqual(multiple.Options, expected) {
+		t.Errorf("expected %v, got %v", expected, multiple.Options)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/oci"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// InitContainer is a one-shot container, run to completion before the
+// main container of the task is started.
+type InitContainer struct {
+	Image   string   `codec:"image"`
+	Command string   `codec:"command"`
+	Args    []string `codec:"args"`
+	Mounts  []Mount  `codec:"mounts"`
+}
+
+// runInitContainers runs the init containers of the task one after the other,
+// and fails as soon as one of them doesn't exit successfully.
+// Init containers share the network namespace, the secrets, task and alloc
+// directories, and the resources of the main container, and their output is
+// written to stdout and stderr, the task's log FIFOs.
+func (d *Driver) runInitContainers(cfg *drivers.TaskConfig, containerConfig *ContainerConfig, config *TaskConfig, stdout, stderr io.Writer) error {
+	for i, initContainer := range config.InitContainers {
+		name := fmt.Sprintf("%s-init-%d", containerConfig.ContainerName, i)
+
+		image, err := d.pullImage(initContainer.Image, config.ImagePullTimeout, &config.Auth)
+		if err != nil {
+			return fmt.Errorf("Error in pulling image %s of init container %d: %v", initContainer.Image, i, err)
+		}
+
+		d.emitEvent(cfg, "Running init container", map[string]string{
+			"container": name,
+			"image":     image.Name(),
+		})
+
+		cgroupsPath := d.cgroupsPath(cfg, fmt.Sprintf("%s-init-%d", cgroupName(cfg), i))
+		exitCode, err := d.runInitContainer(name, cgroupsPath, image, &config.InitContainers[i], containerConfig, config, stdout, stderr)
+		if err != nil {
+			return fmt.Errorf("Error in running init container %s: %v", name, err)
+		}
+		if exitCode != 0 {
+			d.emitEvent(cfg, "Init container failed", map[string]string{
+				"container": name,
+				"exit_code": strconv.Itoa(int(exitCode)),
+			})
+			return fmt.Errorf("Init container %s exited with code %d", name, exitCode)
+		}
+
+		d.logger.Info(fmt.Sprintf("Init container %s completed successfully\n", name))
+	}
+	return nil
+}
+
+// runInitContainer creates and runs a single init container until it exits,
+// and returns its exit code. The container and its snapshot are always
+// removed afterwards.
+func (d *Driver) runInitContainer(name, cgroupsPath string, image containerd.Image, initContainer *InitContainer, containerConfig *ContainerConfig, config *TaskConfig, stdout, stderr io.Writer) (uint32, error) {
+	opts, err := d.buildInitSpecOpts(image, initContainer, containerConfig, config)
+	if err != nil {
+		return 0, err
+	}
+	opts = append(opts, oci.WithCgroup(cgroupsPath))
+
+	// Remove the container left behind by a previous start attempt, if any.
+	if container, err := d.loadContainer(name); err == nil {
+		if err := d.removeContainer(container); err != nil {
+			return 0, err
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return 0, err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	container, err := d.client.NewContainer(
+		ctxWithTimeout,
+		name,
+		d.withRuntime(),
+		containerd.WithContainerLabels(containerConfig.Labels),
+		containerd.WithNewSnapshot(snapshotName(name), image),
+		containerd.WithNewSpec(opts...),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := d.removeContainer(container); err != nil {
+			d.logger.Warn("Error in removing init container", "container", name, "error", err)
+		}
+	}()
+
+	task, err := container.NewTask(ctxWithTimeout, cio.NewCreator(cio.WithStreams(nil, stdout, stderr)))
+	if err != nil {
+		return 0, err
+	}
+
+	exitCh, err := task.Wait(d.ctxContainerd)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := task.Start(ctxWithTimeout); err != nil {
+		return 0, err
+	}
+
+	status := <-exitCh
+	code, _, err := status.Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// Deleting the task waits for its output to be copied to the task's logs.
+	ctxDelete, cancelDelete := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancelDelete()
+	if _, err := task.Delete(ctxDelete); err != nil && !errdefs.IsNotFound(err) {
+		return 0, err
+	}
+	return code, nil
+}
+
+// buildInitSpecOpts returns the options used to generate the spec of an init
+// container. Unlike the main container, only the network, mounts, user,
+// environment, resources and OCI hooks of the task are applied.
+func (d *Driver) buildInitSpecOpts(image containerd.Image, initContainer *InitContainer, containerConfig *ContainerConfig, config *TaskConfig) ([]oci.SpecOpts, error) {
+	// Command set by the user, to override the cmd defined in the image.
+	var args []string
+	if initContainer.Command != "" {
+		args = append(args, initContainer.Command)
+	}
+	args = append(args, initContainer.Args...)
+
+	opts := []oci.SpecOpts{
+		oci.WithImageConfigArgs(image, args),
+		oci.WithEnv(containerConfig.Env),
+		WithMemoryLimits(containerConfig.MemoryLimit, containerConfig.MemoryHardLimit),
+		WithMemorySwap(containerConfig.MemorySwap, containerConfig.Swappiness),
+		oci.WithCPUShares(uint64(containerConfig.CPUShares)),
+		oci.WithHostname(containerConfig.ContainerName),
+	}
+
+	if containerConfig.CPUQuota > 0 {
+		opts = append(opts, oci.WithCPUCFS(containerConfig.CPUQuota, containerConfig.CPUPeriod))
+	}
+	if containerConfig.CpusetCpus != "" {
+		opts = append(opts, oci.WithCPUs(containerConfig.CpusetCpus))
+	}
+	if containerConfig.CpusetMems != "" {
+		opts = append(opts, oci.WithCPUsMems(containerConfig.CpusetMems))
+	}
+	if containerConfig.BlockIO != nil {
+		opts = append(opts, WithBlockIO(containerConfig.BlockIO))
+	}
+	if len(containerConfig.Rlimits) > 0 {
+		opts = append(opts, WithRlimits(containerConfig.Rlimits))
+	}
+	if len(containerConfig.HugepageLimits) > 0 {
+		opts = append(opts, WithHugepageLimits(containerConfig.HugepageLimits))
+	}
+
+	// Init containers run the same OCI hooks as the main container.
+	hooks, err := d.buildHooks(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) > 0 {
+		opts = append(opts, WithHooks(hooks))
+	}
+
+	mounts, err := buildMounts(initContainer.Mounts, containerConfig.TaskDirSrc)
+	if err != nil {
+		return nil, err
+	}
+	if config.HostDNS {
+		dnsMount := buildMountpoint("bind", "/etc/resolv.conf", "/etc/resolv.conf", []string{"rbind", "ro"})
+		mounts = append(mounts, dnsMount)
+	}
+	mounts = append(mounts, taskDirMounts(containerConfig)...)
+	if len(mounts) > 0 {
+		opts = append(opts, oci.WithMounts(mounts))
+	}
+
+	// Join the network of the task.
+	if config.HostNetwork {
+		opts = append(opts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostHostsFile, oci.WithHostResolvconf)
+	}
+	if containerConfig.NetworkNamespacePath != "" {
+		opts = append(opts, oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: containerConfig.NetworkNamespacePath}))
+	}
+
+	if containerConfig.User != "" {
+		opts = append(opts, oci.WithUser(containerConfig.User))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+)
+
+// reapDanglingContainers periodically removes containers created by the driver
+// which are not tracked by any task e.g. containers of allocations garbage
+// collected while the Nomad client was down.
+// The first run is delayed by one period, to give the Nomad client time to
+// recover its tasks after a restart.
+func (d *Driver) reapDanglingContainers(period, grace time.Duration) {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(period)
+		}
+
+		if err := d.removeDanglingContainers(grace); err != nil {
+			d.logger.Warn("Error in removing dangling containers", "error", err)
+		}
+	}
+}
+
+// removeDanglingContainers kills and deletes containers, along with their
+// snapshots, which are labelled with an alloc ID and task name that don't
+// match any tracked or starting task. Containers created less than grace ago
+// are skipped, as their task may be about to be recovered, and so are
+// containers preserved for the next run of their task.
+func (d *Driver) removeDanglingContainers(grace time.Duration) error {
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	// Only consider containers created by the driver.
+	containers, err := d.client.Containers(ctxWithTimeout, fmt.Sprintf("labels.%q", allocIDLabel))
+	if err != nil {
+		return fmt.Errorf("Error in listing containers: %v", err)
+	}
+
+	tracked := make(map[string]struct{})
+	for _, h := range append(d.tasks.List(), d.starting.List()...) {
+		tracked[taskKey(h.taskConfig.AllocID, h.taskConfig.Name)] = struct{}{}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, c := range containers {
+		info, err := c.Info(ctxWithTimeout, containerd.WithoutRefreshedMetadata)
+		if err != nil {
+			return err
+		}
+
+		allocID, taskName := info.Labels[allocIDLabel], info.Labels[taskNameLabel]
+		if _, ok := tracked[taskKey(allocID, taskName)]; ok || info.CreatedAt.After(cutoff) {
+			continue
+		}
+
+		// Containers with a preserved rootfs are kept between two runs of
+		// their task, until the allocation is garbage collected.
+		if info.Labels[preserveRootfsLabel] == "true" && allocDirExists(info.Labels[allocDirLabel]) {
+			continue
+		}
+
+		d.logger.Info("Removing dangling container", "container", c.ID(), "alloc_id", allocID, "task_name", taskName)
+		if err := d.removeContainer(c); err != nil {
+			d.logger.Warn("Error in removing dangling container", "container", c.ID(), "error", err)
+		}
+	}
+	return nil
+}
+
+// removeContainer kills the container's task, if any, and deletes the
+// container along with its snapshot.
+func (d *Driver) removeContainer(c containerd.Container) error {
+	ctxWithTimeout, cancel := context.WithTimeout(d.ctxContainerd, 30*time.Second)
+	defer cancel()
+
+	task, err := c.Task(ctxWithTimeout, nil)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if _, err := task.Delete(ctxWithTimeout, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return c.Delete(ctxWithTimeout, containerd.WithSnapshotCleanup)
+}
+
+// allocDirExists returns true if the alloc dir at path still exists, which
+// means the allocation wasn't garbage collected.
+func allocDirExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// taskKey uniquely identifies a task across allocations.
+func taskKey(allocID, taskName string) string {
+	return allocID + "/" + taskName
+}
@@ -19,12 +19,22 @@ package containerd
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
+	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/containers"
 	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/docker/go-units"
+	"github.com/hashicorp/nomad/plugins/drivers"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 // buildMountpoint builds the mount point for the container.
@@ -75,6 +85,71 @@ func WithSysctls(sysctls map[string]string) oci.SpecOpts {
 	}
 }
 
+// WithInit prepends the init binary at path to the process args, so that it runs
+// as PID 1 with the container process as its child. The init process (e.g. tini or
+// catatonit) forwards the signals it receives to the child's process group.
+func WithInit(path string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil || len(s.Process.Args) == 0 {
+			return fmt.Errorf("no process args to run with init")
+		}
+		s.Process.Args = append([]string{path, "-g", "--"}, s.Process.Args...)
+		return nil
+	}
+}
+
+// WithHooks adds the OCI hooks onto the spec, for the stage each of them is set for.
+func WithHooks(hooks []Hook) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Hooks == nil {
+			s.Hooks = &specs.Hooks{}
+		}
+		for _, hook := range hooks {
+			if !filepath.IsAbs(hook.Path) {
+				return fmt.Errorf("Hook path must be absolute: %s", hook.Path)
+			}
+
+			h := specs.Hook{
+				Path: hook.Path,
+				Args: append([]string{hook.Path}, hook.Args...),
+				Env:  hook.Env,
+			}
+			if hook.Timeout > 0 {
+				timeout := hook.Timeout
+				h.Timeout = &timeout
+			}
+
+			switch hook.Stage {
+			case "prestart":
+				s.Hooks.Prestart = append(s.Hooks.Prestart, h)
+			case "create_runtime":
+				s.Hooks.CreateRuntime = append(s.Hooks.CreateRuntime, h)
+			case "create_container":
+				s.Hooks.CreateContainer = append(s.Hooks.CreateContainer, h)
+			case "start_container":
+				s.Hooks.StartContainer = append(s.Hooks.StartContainer, h)
+			case "poststart":
+				s.Hooks.Poststart = append(s.Hooks.Poststart, h)
+			case "poststop":
+				s.Hooks.Poststop = append(s.Hooks.Poststop, h)
+			default:
+				return fmt.Errorf("Invalid hook stage: %s", hook.Stage)
+			}
+		}
+		return nil
+	}
+}
+
+// isHookAllowed returns true if the hook binary at path is in the allowlist.
+func isHookAllowed(path string, allowed []string) bool {
+	for _, a := range allowed {
+		if filepath.Clean(a) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // WithMemoryLimits accepts soft (`memory`) and hard (`memory_max`) limits as parameters and set the desired
 // limits. With `Nomad<1.1.0` releases, soft (`memory`) will act as a hard limit, and if the container process exceeds
 // that limit, it will be OOM'ed. With `Nomad>=1.1.0` releases, users can over-provision using `soft` and `hard`
@@ -99,3 +174,522 @@ func WithMemoryLimits(soft, hard int64) oci.SpecOpts {
 		return nil
 	}
 }
+
+// parseCPUSet parses a cpuset list e.g. "0-3,7" (see cpuset(7)), and returns
+// the IDs it contains.
+func parseCPUSet(list string) (map[int]struct{}, error) {
+	ids := make(map[int]struct{})
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		low, high, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(low)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("Invalid cpuset %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(high); err != nil || end < start {
+				return nil, fmt.Errorf("Invalid cpuset %q", list)
+			}
+		}
+		for id := start; id <= end; id++ {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids, nil
+}
+
+// validateCPUSet checks that every ID in the cpuset list is online, according
+// to the list of online IDs read from onlinePath, e.g. /sys/devices/system/cpu/online.
+// If onlinePath doesn't exist, the IDs in missingOnline are online, unless
+// missingOnline is empty.
+func validateCPUSet(list, onlinePath, missingOnline string) error {
+	ids, err := parseCPUSet(list)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(onlinePath)
+	if os.IsNotExist(err) && missingOnline != "" {
+		data, err = []byte(missingOnline), nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error in reading %s: %v", onlinePath, err)
+	}
+	online, err := parseCPUSet(string(data))
+	if err != nil {
+		return fmt.Errorf("Error in parsing %s: %v", onlinePath, err)
+	}
+
+	for id := range ids {
+		if _, ok := online[id]; !ok {
+			return fmt.Errorf("%d in cpuset %q is not online", id, list)
+		}
+	}
+	return nil
+}
+
+// WithMemorySwap sets the memory+swap limit of the container, and the swappiness
+// of its cgroup (cgroup v1 only). With cgroup v2, the runtime converts the
+// memory+swap limit to memory.swap.max. A zero swap, or a negative swappiness,
+// is left unset.
+func WithMemorySwap(swap, swappiness int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			if s.Linux.Resources.Memory == nil {
+				s.Linux.Resources.Memory = &specs.LinuxMemory{}
+			}
+
+			if swap != 0 {
+				s.Linux.Resources.Memory.Swap = &swap
+			}
+			if swappiness >= 0 {
+				value := uint64(swappiness)
+				s.Linux.Resources.Memory.Swappiness = &value
+			}
+		}
+		return nil
+	}
+}
+
+// parseMemorySwap parses a memory+swap limit e.g. "2g", or "-1" for unlimited swap.
+func parseMemorySwap(value string) (int64, error) {
+	if value == "-1" {
+		return -1, nil
+	}
+	swap, err := units.RAMInBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	if swap <= 0 {
+		return 0, fmt.Errorf("memory_swap must be greater than zero, or -1 for unlimited swap")
+	}
+	return swap, nil
+}
+
+// WithBlockIO sets the block IO weight and throttling of the container.
+// With cgroup v2, the runtime converts them to io.weight and io.max.
+func WithBlockIO(blockIO *specs.LinuxBlockIO) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			s.Linux.Resources.BlockIO = blockIO
+		}
+		return nil
+	}
+}
+
+// buildBlockIO converts the blkio block of the task config to the OCI block IO
+// settings, resolving device paths to their major:minor numbers.
+// It returns nil if the block is empty.
+func buildBlockIO(config *BlkioConfig) (*specs.LinuxBlockIO, error) {
+	blockIO := &specs.LinuxBlockIO{}
+	empty := true
+
+	if config.Weight != 0 {
+		if config.Weight < 10 || config.Weight > 1000 {
+			return nil, fmt.Errorf("weight must be between 10 and 1000")
+		}
+		blockIO.Weight = &config.Weight
+		empty = false
+	}
+
+	for _, entry := range config.WeightDevice {
+		path, value, err := splitDeviceValue(entry)
+		if err != nil {
+			return nil, err
+		}
+		weight, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || weight < 10 || weight > 1000 {
+			return nil, fmt.Errorf("Invalid weight_device %q: weight must be between 10 and 1000", entry)
+		}
+		major, minor, err := blockDeviceNumbers(path)
+		if err != nil {
+			return nil, err
+		}
+		device := specs.LinuxWeightDevice{}
+		device.Major, device.Minor = major, minor
+		w := uint16(weight)
+		device.Weight = &w
+		blockIO.WeightDevice = append(blockIO.WeightDevice, device)
+		empty = false
+	}
+
+	throttles := []struct {
+		name    string
+		entries []string
+		bytes   bool
+		dest    *[]specs.LinuxThrottleDevice
+	}{
+		{"read_bps", config.ReadBps, true, &blockIO.ThrottleReadBpsDevice},
+		{"write_bps", config.WriteBps, true, &blockIO.ThrottleWriteBpsDevice},
+		{"read_iops", config.ReadIops, false, &blockIO.ThrottleReadIOPSDevice},
+		{"write_iops", config.WriteIops, false, &blockIO.ThrottleWriteIOPSDevice},
+	}
+	for _, throttle := range throttles {
+		for _, entry := range throttle.entries {
+			path, value, err := splitDeviceValue(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			// Rates in bytes per second accept units e.g. 10mb.
+			var rate uint64
+			if throttle.bytes {
+				bytes, err := units.RAMInBytes(value)
+				if err != nil || bytes <= 0 {
+					return nil, fmt.Errorf("Invalid %s %q: rate must be a positive size e.g. 10mb", throttle.name, entry)
+				}
+				rate = uint64(bytes)
+			} else if rate, err = strconv.ParseUint(value, 10, 64); err != nil || rate == 0 {
+				return nil, fmt.Errorf("Invalid %s %q: rate must be a positive integer", throttle.name, entry)
+			}
+
+			major, minor, err := blockDeviceNumbers(path)
+			if err != nil {
+				return nil, err
+			}
+			device := specs.LinuxThrottleDevice{Rate: rate}
+			device.Major, device.Minor = major, minor
+			*throttle.dest = append(*throttle.dest, device)
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil, nil
+	}
+	return blockIO, nil
+}
+
+// splitDeviceValue splits a per-device setting given as <device path>:<value>.
+func splitDeviceValue(entry string) (string, string, error) {
+	path, value, ok := strings.Cut(entry, ":")
+	if !ok || path == "" || value == "" {
+		return "", "", fmt.Errorf("Invalid device setting %q, expected <device path>:<value>", entry)
+	}
+	return path, value, nil
+}
+
+// blockDeviceNumbers returns the major and minor numbers of the block device at path.
+func blockDeviceNumbers(path string) (int64, int64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("Error in reading device %s: %v", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", path)
+	}
+	return int64(unix.Major(uint64(stat.Rdev))), int64(unix.Minor(uint64(stat.Rdev))), nil
+}
+
+// WithRlimits sets the resource limits of the container process, replacing the
+// default limits of the same type.
+func WithRlimits(rlimits []specs.POSIXRlimit) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		for _, rlimit := range rlimits {
+			replaced := false
+			for i := range s.Process.Rlimits {
+				if s.Process.Rlimits[i].Type == rlimit.Type {
+					s.Process.Rlimits[i] = rlimit
+					replaced = true
+				}
+			}
+			if !replaced {
+				s.Process.Rlimits = append(s.Process.Rlimits, rlimit)
+			}
+		}
+		return nil
+	}
+}
+
+// ulimitNames are the resources which can be limited with ulimit.
+var ulimitNames = map[string]struct{}{
+	"as": {}, "core": {}, "cpu": {}, "data": {}, "fsize": {}, "locks": {},
+	"memlock": {}, "msgqueue": {}, "nice": {}, "nofile": {}, "nproc": {},
+	"rss": {}, "rtprio": {}, "rttime": {}, "sigpending": {}, "stack": {},
+}
+
+// parseUlimit parses a ulimit given in docker syntax i.e. <soft>:<hard>, or a
+// single value used for both the soft and hard limits. "unlimited" (or -1)
+// removes the limit.
+func parseUlimit(name, value string) (specs.POSIXRlimit, error) {
+	if _, ok := ulimitNames[name]; !ok {
+		return specs.POSIXRlimit{}, fmt.Errorf("Invalid ulimit %s", name)
+	}
+
+	parse := func(v string) (uint64, error) {
+		if v == "unlimited" || v == "-1" {
+			return ^uint64(0), nil
+		}
+		return strconv.ParseUint(v, 10, 64)
+	}
+
+	softValue, hardValue, ok := strings.Cut(value, ":")
+	if !ok {
+		hardValue = softValue
+	}
+	soft, err := parse(softValue)
+	if err != nil {
+		return specs.POSIXRlimit{}, fmt.Errorf("Invalid %s ulimit %q: %v", name, value, err)
+	}
+	hard, err := parse(hardValue)
+	if err != nil {
+		return specs.POSIXRlimit{}, fmt.Errorf("Invalid %s ulimit %q: %v", name, value, err)
+	}
+	if soft > hard {
+		return specs.POSIXRlimit{}, fmt.Errorf("Invalid %s ulimit %q: soft limit is greater than hard limit", name, value)
+	}
+
+	return specs.POSIXRlimit{
+		Type: "RLIMIT_" + strings.ToUpper(name),
+		Soft: soft,
+		Hard: hard,
+	}, nil
+}
+
+// WithOOMScoreAdj sets the OOM score adjustment of the container process.
+func WithOOMScoreAdj(score int) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		s.Process.OOMScoreAdj = &score
+		return nil
+	}
+}
+
+// WithOOMGroup makes the OOM killer kill all processes of the container
+// together, instead of a single process (cgroup v2 only).
+func WithOOMGroup() oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			if s.Linux.Resources.Unified == nil {
+				s.Linux.Resources.Unified = make(map[string]string)
+			}
+			s.Linux.Resources.Unified["memory.oom.group"] = "1"
+		}
+		return nil
+	}
+}
+
+// WithCgroupUnified sets cgroup v2 settings of the container, keyed by
+// cgroup file name e.g. memory.high.
+func WithCgroupUnified(unified map[string]string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			if s.Linux.Resources.Unified == nil {
+				s.Linux.Resources.Unified = make(map[string]string)
+			}
+			for key, value := range unified {
+				s.Linux.Resources.Unified[key] = value
+			}
+		}
+		return nil
+	}
+}
+
+// parseDevice parses a device mapping given in docker syntax i.e.
+// <host path>[:<container path>][:<permissions>]. The container path defaults
+// to the host path, and permissions (a combination of r, w and m) to rwm.
+func parseDevice(device string) (string, string, string, error) {
+	parts := strings.Split(device, ":")
+	hostPath, containerPath, permissions := parts[0], parts[0], "rwm"
+
+	switch len(parts) {
+	case 1:
+	case 2:
+		if isDevicePermissions(parts[1]) {
+			permissions = parts[1]
+		} else {
+			containerPath = parts[1]
+		}
+	case 3:
+		containerPath, permissions = parts[1], parts[2]
+	default:
+		return "", "", "", fmt.Errorf("Invalid device %q", device)
+	}
+
+	if hostPath == "" || !strings.HasPrefix(containerPath, "/") {
+		return "", "", "", fmt.Errorf("Invalid device %q: paths must be absolute", device)
+	}
+	if !isDevicePermissions(permissions) {
+		return "", "", "", fmt.Errorf("Invalid device %q: permissions must be a combination of r, w and m", device)
+	}
+	return hostPath, containerPath, permissions, nil
+}
+
+// isDevicePermissions returns true if permissions is a non-empty combination
+// of r (read), w (write) and m (mknod).
+func isDevicePermissions(permissions string) bool {
+	if permissions == "" || len(permissions) > 3 {
+		return false
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune("rwm", c) || strings.Count(permissions, string(c)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDeviceCgroupRules parses device cgroup rules given in docker syntax
+// i.e. <type> <major>:<minor> <permissions> e.g. "c 189:* rmw", where type
+// is a (all), b (block) or c (char), and * matches any major or minor number.
+func parseDeviceCgroupRules(rules []string) ([]specs.LinuxDeviceCgroup, error) {
+	var deviceRules []specs.LinuxDeviceCgroup
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q", rule)
+		}
+
+		deviceType, numbers, permissions := fields[0], fields[1], fields[2]
+		if deviceType != "a" && deviceType != "b" && deviceType != "c" {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q: type must be a, b or c", rule)
+		}
+		if !isDevicePermissions(permissions) {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q: permissions must be a combination of r, w and m", rule)
+		}
+
+		majorValue, minorValue, ok := strings.Cut(numbers, ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q: expected <major>:<minor>", rule)
+		}
+		major, err := parseDeviceNumber(majorValue)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q: %v", rule, err)
+		}
+		minor, err := parseDeviceNumber(minorValue)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid device cgroup rule %q: %v", rule, err)
+		}
+
+		deviceRules = append(deviceRules, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   deviceType,
+			Major:  major,
+			Minor:  minor,
+			Access: permissions,
+		})
+	}
+	return deviceRules, nil
+}
+
+// parseDeviceNumber parses a major or minor device number, or * which matches
+// any number and is returned as nil.
+func parseDeviceNumber(value string) (*int64, error) {
+	if value == "*" {
+		return nil, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return nil, fmt.Errorf("invalid device number %q", value)
+	}
+	return &number, nil
+}
+
+// WithDeviceCgroupRules allows access to the devices matching the rules.
+func WithDeviceCgroupRules(rules []specs.LinuxDeviceCgroup) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux != nil {
+			if s.Linux.Resources == nil {
+				s.Linux.Resources = &specs.LinuxResources{}
+			}
+			s.Linux.Resources.Devices = append(s.Linux.Resources.Devices, rules...)
+		}
+		return nil
+	}
+}
+
+// snapshotName returns the name of the snapshot backing the container's rootfs.
+func snapshotName(containerName string) string {
+	return fmt.Sprintf("%s-snapshot", containerName)
+}
+
+// hostsFilePath returns the path of the /etc/hosts file generated for the
+// container, given the task's local dir.
+func hostsFilePath(taskDirSrc string) string {
+	return filepath.Join(taskDirSrc, "etc_hosts")
+}
+
+// nopWriteCloser adds a no-op Close method to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// tailLog returns up to the last n lines of the most recent log file, rotated
+// by Nomad as <prefix>.<index> in logDir.
+func tailLog(logDir, prefix string, n int) string {
+	files, err := filepath.Glob(filepath.Join(logDir, prefix+".*"))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+
+	latest, latestIndex := "", -1
+	for _, f := range files {
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(f), "."))
+		if err == nil && index > latestIndex {
+			latest, latestIndex = f, index
+		}
+	}
+	if latest == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(latest)
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkpointDir returns the directory in which the task checkpoint is stored.
+// The directory lives in the task's alloc dir, so it survives task restarts
+// within the same allocation.
+func checkpointDir(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().Dir, "checkpoint")
+}
+
+// hasCheckpoint returns true if a CRIU checkpoint exists in dir.
+func hasCheckpoint(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "inventory.img"))
+	return err == nil
+}
+
+// withCheckpointExit stops the task once the checkpoint is taken.
+// This must be set after WithCheckpointImagePath, which picks the
+// checkpoint options type for the runtime.
+func withCheckpointExit(r *containerd.CheckpointTaskInfo) error {
+	if r.Options == nil {
+		r.Options = &options.CheckpointOptions{}
+	}
+	opts, ok := r.Options.(*options.CheckpointOptions)
+	if !ok {
+		return fmt.Errorf("checkpoint is not supported by runtime: %s", r.Runtime())
+	}
+	opts.Exit = true
+	return nil
+}
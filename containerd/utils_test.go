@@ -0,0 +1,468 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package containerd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseUlimit(t *testing.T) {
+	unlimited := ^uint64(0)
+
+	cases := []struct {
+		name     string
+		ulimit   string
+		value    string
+		expected specs.POSIXRlimit
+		err      bool
+	}{
+		{name: "single value", ulimit: "nofile", value: "1024", expected: specs.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024}},
+		{name: "soft and hard", ulimit: "nofile", value: "1024:2048", expected: specs.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 2048}},
+		{name: "unlimited", ulimit: "memlock", value: "unlimited", expected: specs.POSIXRlimit{Type: "RLIMIT_MEMLOCK", Soft: unlimited, Hard: unlimited}},
+		{name: "minus one", ulimit: "core", value: "-1", expected: specs.POSIXRlimit{Type: "RLIMIT_CORE", Soft: unlimited, Hard: unlimited}},
+		{name: "unlimited hard", ulimit: "stack", value: "8192:unlimited", expected: specs.POSIXRlimit{Type: "RLIMIT_STACK", Soft: 8192, Hard: unlimited}},
+		{name: "soft greater than hard", ulimit: "nofile", value: "2048:1024", err: true},
+		{name: "unlimited soft with hard", ulimit: "nofile", value: "unlimited:1024", err: true},
+		{name: "unknown name", ulimit: "files", value: "1024", err: true},
+		{name: "negative", ulimit: "nofile", value: "-2", err: true},
+		{name: "not a number", ulimit: "nofile", value: "lots", err: true},
+		{name: "empty", ulimit: "nofile", value: "", err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rlimit, err := parseUlimit(tc.ulimit, tc.value)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", rlimit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(rlimit, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, rlimit)
+			}
+		})
+	}
+}
+
+// testBlockDevice returns the path and device numbers of a block device of
+// the node, or skips the test if there is none.
+func testBlockDevice(t *testing.T) (string, int64, int64) {
+	t.Helper()
+	paths, _ := filepath.Glob("/dev/*")
+	for _, path := range paths {
+		var stat unix.Stat_t
+		if err := unix.Stat(path, &stat); err == nil && stat.Mode&unix.S_IFMT == unix.S_IFBLK {
+			return path, int64(unix.Major(uint64(stat.Rdev))), int64(unix.Minor(uint64(stat.Rdev)))
+		}
+	}
+	t.Skip("no block device found in /dev")
+	return "", 0, 0
+}
+
+func TestSplitDeviceValue(t *testing.T) {
+	cases := []struct {
+		entry string
+		path  string
+		value string
+		err   bool
+	}{
+		{entry: "/dev/sda:500", path: "/dev/sda", value: "500"},
+		{entry: "/dev/sda:10mb", path: "/dev/sda", value: "10mb"},
+		{entry: "/dev/sda", err: true},
+		{entry: ":500", err: true},
+		{entry: "/dev/sda:", err: true},
+		{entry: "", err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.entry, func(t *testing.T) {
+			path, value, err := splitDeviceValue(tc.entry)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s and %s", path, value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if path != tc.path || value != tc.value {
+				t.Errorf("expected %s and %s, got %s and %s", tc.path, tc.value, path, value)
+			}
+		})
+	}
+}
+
+func TestBuildBlockIO(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   BlkioConfig
+		expected func(major, minor int64) *specs.LinuxBlockIO
+		device   bool
+		err      bool
+	}{
+		{
+			name:     "empty",
+			config:   BlkioConfig{},
+			expected: func(_, _ int64) *specs.LinuxBlockIO { return nil },
+		},
+		{
+			name:   "minimum weight",
+			config: BlkioConfig{Weight: 10},
+			expected: func(_, _ int64) *specs.LinuxBlockIO {
+				weight := uint16(10)
+				return &specs.LinuxBlockIO{Weight: &weight}
+			},
+		},
+		{
+			name:   "maximum weight",
+			config: BlkioConfig{Weight: 1000},
+			expected: func(_, _ int64) *specs.LinuxBlockIO {
+				weight := uint16(1000)
+				return &specs.LinuxBlockIO{Weight: &weight}
+			},
+		},
+		{name: "weight too low", config: BlkioConfig{Weight: 9}, err: true},
+		{name: "weight too high", config: BlkioConfig{Weight: 1001}, err: true},
+		{
+			name:   "weight device",
+			config: BlkioConfig{WeightDevice: []string{"DEVICE:500"}},
+			device: true,
+			expected: func(major, minor int64) *specs.LinuxBlockIO {
+				weight := uint16(500)
+				device := specs.LinuxWeightDevice{Weight: &weight}
+				device.Major, device.Minor = major, minor
+				return &specs.LinuxBlockIO{WeightDevice: []specs.LinuxWeightDevice{device}}
+			},
+		},
+		{name: "weight device too low", config: BlkioConfig{WeightDevice: []string{"DEVICE:5"}}, device: true, err: true},
+		{name: "weight device too high", config: BlkioConfig{WeightDevice: []string{"DEVICE:1001"}}, device: true, err: true},
+		{name: "weight device without weight", config: BlkioConfig{WeightDevice: []string{"DEVICE"}}, device: true, err: true},
+		{
+			name:   "bps with units",
+			config: BlkioConfig{ReadBps: []string{"DEVICE:10mb"}, WriteBps: []string{"DEVICE:1g"}},
+			device: true,
+			expected: func(major, minor int64) *specs.LinuxBlockIO {
+				read := specs.LinuxThrottleDevice{Rate: 10 * 1024 * 1024}
+				read.Major, read.Minor = major, minor
+				write := specs.LinuxThrottleDevice{Rate: 1024 * 1024 * 1024}
+				write.Major, write.Minor = major, minor
+				return &specs.LinuxBlockIO{
+					ThrottleReadBpsDevice:  []specs.LinuxThrottleDevice{read},
+					ThrottleWriteBpsDevice: []specs.LinuxThrottleDevice{write},
+				}
+			},
+		},
+		{
+			name:   "bps in bytes",
+			config: BlkioConfig{ReadBps: []string{"DEVICE:4096"}},
+			device: true,
+			expected: func(major, minor int64) *specs.LinuxBlockIO {
+				read := specs.LinuxThrottleDevice{Rate: 4096}
+				read.Major, read.Minor = major, minor
+				return &specs.LinuxBlockIO{ThrottleReadBpsDevice: []specs.LinuxThrottleDevice{read}}
+			},
+		},
+		{name: "bps zero", config: BlkioConfig{ReadBps: []string{"DEVICE:0"}}, device: true, err: true},
+		{name: "bps invalid unit", config: BlkioConfig{WriteBps: []string{"DEVICE:10xb"}}, device: true, err: true},
+		{
+			name:   "iops",
+			config: BlkioConfig{ReadIops: []string{"DEVICE:100"}, WriteIops: []string{"DEVICE:50"}},
+			device: true,
+			expected: func(major, minor int64) *specs.LinuxBlockIO {
+				read := specs.LinuxThrottleDevice{Rate: 100}
+				read.Major, read.Minor = major, minor
+				write := specs.LinuxThrottleDevice{Rate: 50}
+				write.Major, write.Minor = major, minor
+				return &specs.LinuxBlockIO{
+					ThrottleReadIOPSDevice:  []specs.LinuxThrottleDevice{read},
+					ThrottleWriteIOPSDevice: []specs.LinuxThrottleDevice{write},
+				}
+			},
+		},
+		{name: "iops with units", config: BlkioConfig{ReadIops: []string{"DEVICE:10mb"}}, device: true, err: true},
+		{name: "iops zero", config: BlkioConfig{WriteIops: []string{"DEVICE:0"}}, device: true, err: true},
+		{name: "malformed entry", config: BlkioConfig{ReadBps: []string{"10mb"}}, err: true},
+		{name: "not a block device", config: BlkioConfig{ReadBps: []string{"/dev/null:10mb"}}, err: true},
+		{name: "missing device", config: BlkioConfig{ReadIops: []string{"/dev/does-not-exist:100"}}, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var major, minor int64
+			config := tc.config
+			if tc.device {
+				var path string
+				path, major, minor = testBlockDevice(t)
+				replace := func(entries []string) []string {
+					var replaced []string
+					for _, entry := range entries {
+						replaced = append(replaced, strings.Replace(entry, "DEVICE", path, 1))
+					}
+					return replaced
+				}
+				config.WeightDevice = replace(config.WeightDevice)
+				config.ReadBps, config.WriteBps = replace(config.ReadBps), replace(config.WriteBps)
+				config.ReadIops, config.WriteIops = replace(config.ReadIops), replace(config.WriteIops)
+			}
+
+			blockIO, err := buildBlockIO(&config)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", blockIO)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := tc.expected(major, minor); !reflect.DeepEqual(blockIO, expected) {
+				t.Errorf("expected %+v, got %+v", expected, blockIO)
+			}
+		})
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	cases := []struct {
+		list     string
+		expected []int
+		err      bool
+	}{
+		{list: "0", expected: []int{0}},
+		{list: "0-3", expected: []int{0, 1, 2, 3}},
+		{list: "0-1,4,6-7", expected: []int{0, 1, 4, 6, 7}},
+		{list: "2-2", expected: []int{2}},
+		{list: "0-3\n", expected: []int{0, 1, 2, 3}},
+		{list: "3-1", err: true},
+		{list: "-1", err: true},
+		{list: "0-", err: true},
+		{list: "0,,1", err: true},
+		{list: "a-b", err: true},
+		{list: "", err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.list, func(t *testing.T) {
+			ids, err := parseCPUSet(tc.list)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ids)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := make(map[int]struct{})
+			for _, id := range tc.expected {
+				expected[id] = struct{}{}
+			}
+			if !reflect.DeepEqual(ids, expected) {
+				t.Errorf("expected %v, got %v", expected, ids)
+			}
+		})
+	}
+}
+
+func TestValidateCPUSet(t *testing.T) {
+	// The fixture lists CPUs 0-3 and 6-7 as online.
+	onlinePath := filepath.Join("testdata", "cpu_online")
+
+	cases := []struct {
+		list string
+		err  bool
+	}{
+		{list: "0"},
+		{list: "0-3"},
+		{list: "1,3,6-7"},
+		{list: "4", err: true},
+		{list: "2-5", err: true},
+		{list: "7-8", err: true},
+		{list: "3-0", err: true},
+		{list: "x", err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.list, func(t *testing.T) {
+			err := validateCPUSet(tc.list, onlinePath, "")
+			if tc.err && err == nil {
+				t.Error("expected an error")
+			}
+			if !tc.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("missing online file", func(t *testing.T) {
+		if err := validateCPUSet("0", filepath.Join(t.TempDir(), "online"), ""); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("missing online file with default", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "online")
+		if err := validateCPUSet("0", path, "0"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := validateCPUSet("0-1", path, "0"); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("invalid online file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "online")
+		if err := os.WriteFile(path, []byte("garbage\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateCPUSet("0", path, "0"); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestParseDevice(t *testing.T) {
+	cases := []struct {
+		device        string
+		hostPath      string
+		containerPath string
+		permissions   string
+		err           bool
+	}{
+		{device: "/dev/fuse", hostPath: "/dev/fuse", containerPath: "/dev/fuse", permissions: "rwm"},
+		{device: "/dev/fuse:r", hostPath: "/dev/fuse", containerPath: "/dev/fuse", permissions: "r"},
+		{device: "/dev/fuse:mw", hostPath: "/dev/fuse", containerPath: "/dev/fuse", permissions: "mw"},
+		{device: "/dev/sda:/dev/xvda", hostPath: "/dev/sda", containerPath: "/dev/xvda", permissions: "rwm"},
+		{device: "/dev/sda:/dev/xvda:rw", hostPath: "/dev/sda", containerPath: "/dev/xvda", permissions: "rw"},
+		{device: "/dev/sda:/dev/xvda:rx", err: true},
+		{device: "/dev/sda:/dev/xvda:", err: true},
+		{device: "/dev/sda:xvda", err: true},
+		{device: "/dev/sda:/dev/xvda:rw:extra", err: true},
+		{device: ":/dev/xvda", err: true},
+		{device: "", err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.device, func(t *testing.T) {
+			hostPath, containerPath, permissions, err := parseDevice(tc.device)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s, %s and %s", hostPath, containerPath, permissions)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hostPath != tc.hostPath || containerPath != tc.containerPath || permissions != tc.permissions {
+				t.Errorf("expected %s, %s and %s, got %s, %s and %s", tc.hostPath, tc.containerPath, tc.permissions, hostPath, containerPath, permissions)
+			}
+		})
+	}
+}
+
+func TestIsDevicePermissions(t *testing.T) {
+	cases := map[string]bool{
+		"r":    true,
+		"rw":   true,
+		"rwm":  true,
+		"mwr":  true,
+		"":     false,
+		"rr":   false,
+		"rwx":  false,
+		"rwmr": false,
+		"/dev": false,
+	}
+
+	for permissions, expected := range cases {
+		if isDevicePermissions(permissions) != expected {
+			t.Errorf("expected isDevicePermissions(%q) to be %v", permissions, expected)
+		}
+	}
+}
+
+func TestParseDeviceCgroupRules(t *testing.T) {
+	number := func(n int64) *int64 { return &n }
+
+	cases := []struct {
+		name     string
+		rules    []string
+		expected []specs.LinuxDeviceCgroup
+		err      bool
+	}{
+		{
+			name:  "char device",
+			rules: []string{"c 189:1 rmw"},
+			expected: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "c", Major: number(189), Minor: number(1), Access: "rmw"},
+			},
+		},
+		{
+			name:  "any minor",
+			rules: []string{"c 189:* rw"},
+			expected: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "c", Major: number(189), Access: "rw"},
+			},
+		},
+		{
+			name:  "any major and minor",
+			rules: []string{"b *:* r", "a *:* m"},
+			expected: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "b", Access: "r"},
+				{Allow: true, Type: "a", Access: "m"},
+			},
+		},
+		{name: "bad type", rules: []string{"d 189:* rwm"}, err: true},
+		{name: "bad permissions", rules: []string{"c 189:* rwx"}, err: true},
+		{name: "missing minor", rules: []string{"c 189 rwm"}, err: true},
+		{name: "bad major", rules: []string{"c x:1 rwm"}, err: true},
+		{name: "negative minor", rules: []string{"c 189:-1 rwm"}, err: true},
+		{name: "missing permissions", rules: []string{"c 189:*"}, err: true},
+		{name: "extra field", rules: []string{"c 189:* rwm extra"}, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseDeviceCgroupRules(tc.rules)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(rules, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, rules)
+			}
+		})
+	}
+}
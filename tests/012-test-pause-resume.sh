@@ -0,0 +1,71 @@
+#!/bin/bash
+
+source $SRCDIR/utils.sh
+
+job_name=hello
+
+# PAUSE and RESUME pseudo-signals freeze and thaw the task's cgroup.
+test_pause_resume_nomad_job() {
+    pushd ~/go/src/github.com/Roblox/nomad-driver-containerd/example
+
+    echo "INFO: Starting nomad $job_name job using nomad-driver-containerd."
+    nomad job run -detach $job_name.nomad
+
+    # Even though $(nomad job status) reports job status as "running"
+    # The actual container process might not be running yet.
+    # We need to wait for actual container to start running before sending signals.
+    echo "INFO: Wait for ${job_name} container to get into RUNNING state, before sending signals."
+    is_container_active ${job_name} true
+
+    alloc_id=$(nomad job status ${job_name}|awk 'END{print}'|cut -d ' ' -f 1)
+
+    echo "INFO: Pausing ${job_name} task."
+    nomad alloc signal -s PAUSE $alloc_id ${job_name}-task
+    if ! is_task_status ${job_name} PAUSED; then
+        echo "ERROR: ${job_name} task didn't get paused."
+        exit 1
+    fi
+
+    echo "INFO: Resuming ${job_name} task."
+    nomad alloc signal -s RESUME $alloc_id ${job_name}-task
+    if ! is_task_status ${job_name} RUNNING; then
+        echo "ERROR: ${job_name} task didn't get resumed."
+        exit 1
+    fi
+
+    # A paused task is resumed before being signalled, so that it can be stopped.
+    echo "INFO: Stopping paused ${job_name} task."
+    nomad alloc signal -s PAUSE $alloc_id ${job_name}-task
+    if ! is_task_status ${job_name} PAUSED; then
+        echo "ERROR: ${job_name} task didn't get paused."
+        exit 1
+    fi
+    nomad job stop ${job_name}
+    job_status=$(nomad job status -short ${job_name}|grep Status|awk '{split($0,a,"="); print a[2]}'|tr -d ' ')
+    if [ "$job_status" != "dead(stopped)" ];then
+        echo "ERROR: Error in stopping paused ${job_name} job."
+        exit 1
+    fi
+
+    echo "INFO: purge nomad ${job_name} job."
+    nomad job stop -detach -purge ${job_name}
+    popd
+}
+
+# is_task_status checks the containerd status of the job's task.
+is_task_status() {
+    local job_name=$1
+    local expected_status=$2
+
+    local i=0
+    while [ $i -lt 5 ]; do
+        if sudo CONTAINERD_NAMESPACE=nomad ctr task ls|grep ${job_name}|grep -q ${expected_status}; then
+            return 0
+        fi
+        sleep 2s
+        i=$((i + 1))
+    done
+    return 1
+}
+
+test_pause_resume_nomad_job
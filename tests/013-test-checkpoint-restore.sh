@@ -0,0 +1,57 @@
+#!/bin/bash
+
+source $SRCDIR/utils.sh
+
+job_name=checkpoint
+
+# checkpoint_on_stop checkpoints the task when it is stopped, and restores it
+# on the next start e.g. when the allocation is restarted.
+test_checkpoint_restore_nomad_job() {
+    if ! command -v criu &>/dev/null; then
+        echo "INFO: criu is not installed, skipping ${job_name} test."
+        return 0
+    fi
+
+    pushd ~/go/src/github.com/Roblox/nomad-driver-containerd/example
+
+    echo "INFO: Starting nomad $job_name job using nomad-driver-containerd."
+    nomad job run -detach $job_name.nomad
+
+    # Even though $(nomad job status) reports job status as "running"
+    # The actual container process might not be running yet.
+    # We need to wait for actual container to start running before restarting it.
+    echo "INFO: Wait for ${job_name} container to get into RUNNING state, before restarting it."
+    is_container_active ${job_name} true
+
+    # Let the count get well above what a fresh task reaches while being checked.
+    sleep 15s
+
+    alloc_id=$(nomad job status ${job_name}|awk 'END{print}'|cut -d ' ' -f 1)
+    count=$(nomad alloc logs $alloc_id|tail -n 1|awk '{print $2}')
+
+    echo "INFO: Restarting ${job_name} allocation."
+    nomad alloc restart $alloc_id
+    is_container_active ${job_name} true
+
+    output=$(nomad alloc status $alloc_id)
+    for event in "Task checkpointed" "Task restored from checkpoint"; do
+        echo -e "$output" |grep "$event" &>/dev/null
+        if [ $? -ne 0 ];then
+           echo "ERROR: $event event not found."
+           exit 1
+        fi
+    done
+
+    # The restored process carries on counting, instead of starting over.
+    restored_count=$(nomad alloc logs $alloc_id|tail -n 1|awk '{print $2}')
+    if [ "$restored_count" -le "$count" ]; then
+        echo "ERROR: ${job_name} task wasn't restored: count went from $count to $restored_count."
+        exit 1
+    fi
+
+    echo "INFO: purge nomad ${job_name} job."
+    nomad job stop -detach -purge ${job_name}
+    popd
+}
+
+test_checkpoint_restore_nomad_job
@@ -0,0 +1,56 @@
+#!/bin/bash
+
+source $SRCDIR/utils.sh
+job_name=init
+init_path=/usr/bin/tini-static
+
+# init = true runs the init binary set with init_path in the plugin config as PID 1.
+test_init_nomad_job() {
+    pushd ~/go/src/github.com/Roblox/nomad-driver-containerd/example
+
+    if [ ! -e $init_path ]; then
+        echo "INFO: Installing tini."
+        sudo apt-get install -y tini
+    fi
+
+    cp agent.hcl agent.hcl.bkp
+
+    sed -i "9 i \    init_path = \"${init_path}\"" agent.hcl
+    sudo systemctl restart nomad
+    is_systemd_service_active "nomad.service" true
+
+    echo "INFO: Starting nomad ${job_name} job using nomad-driver-containerd."
+    nomad job run -detach ${job_name}.nomad
+
+    # Even though $(nomad job status) reports job status as "running"
+    # The actual container process might not be running yet.
+    # We need to wait for actual container to start running before trying exec.
+    echo "INFO: Wait for ${job_name} container to get into RUNNING state, before trying exec."
+    is_container_active ${job_name} true
+
+    echo "INFO: Checking PID 1 of ${job_name} container."
+    output=$(nomad alloc exec -job ${job_name} cat /proc/1/cmdline|tr '\0' ' ')
+    echo -e "$output" |grep "nomad-init -g -- sleep infinity" &>/dev/null
+    if [ $? -ne 0 ];then
+       echo "ERROR: PID 1 of ${job_name} container is not the init process: $output"
+       exit 1
+    fi
+
+    echo "INFO: purge nomad ${job_name} job."
+    nomad job stop -detach -purge ${job_name}
+
+    mv agent.hcl.bkp agent.hcl
+    popd
+}
+
+cleanup() {
+    if [ -f agent.hcl.bkp ]; then
+       mv agent.hcl.bkp agent.hcl
+    fi
+    sudo systemctl restart nomad
+    is_systemd_service_active "nomad.service" false
+}
+
+trap cleanup EXIT
+
+test_init_nomad_job
@@ -0,0 +1,42 @@
+#!/bin/bash
+
+source $SRCDIR/utils.sh
+
+# startup_grace only reports the task as started once it is ready, and fails
+# to start tasks exiting during the grace period.
+test_startup_grace_nomad_job() {
+    pushd ~/go/src/github.com/Roblox/nomad-driver-containerd/example
+
+    local job_name=startup_grace
+    echo "INFO: Starting nomad $job_name job using nomad-driver-containerd."
+    nomad job run -detach $job_name.nomad
+
+    echo "INFO: Wait for ${job_name} container to get into RUNNING state."
+    is_container_active ${job_name} true
+
+    echo "INFO: Checking status of $job_name job."
+    wait_nomad_job_status $job_name running
+
+    echo "INFO: purge nomad ${job_name} job."
+    nomad job stop -detach -purge ${job_name}
+
+    job_name=startup_grace_fail
+    echo "INFO: Starting nomad $job_name job using nomad-driver-containerd."
+    nomad job run -detach $job_name.nomad
+    wait_nomad_job_status $job_name failed
+
+    echo "INFO: Checking status of ${job_name} job."
+    alloc_id=$(nomad job status ${job_name}|grep failed|awk 'NR==1'|cut -d ' ' -f 1)
+    output=$(nomad alloc status $alloc_id)
+    echo -e "$output" |grep "task exited with code 3 during startup_grace" &>/dev/null
+    if [ $? -ne 0 ];then
+       echo "ERROR: ${job_name} should have failed to start."
+       exit 1
+    fi
+
+    echo "INFO: purge nomad ${job_name} job."
+    nomad job stop -detach -purge ${job_name}
+    popd
+}
+
+test_startup_grace_nomad_job